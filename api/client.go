@@ -1,18 +1,24 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strings"
 	"time"
+
+	"github.com/wukezhan/rainbow/metrics"
+	"github.com/wukezhan/rainbow/rlog"
 )
 
 type Api struct {
 	Base string
 	//URL    string
 	Secret string
+	// Ctx carries the trace of the calls, e.g. the one of a session
+	Ctx context.Context
 }
 
 func New() *Api {
@@ -33,17 +39,55 @@ type UserKey struct {
 	FingerPrint string `json:"fingerprint"`
 }
 
+type UserTOTP struct {
+	Secret string   `json:"secret"`
+	Groups []string `json:"groups"`
+}
+
 type UserContainer struct {
 	PodName    string   `json:"pod_name"`
 	NodeName   string   `json:"node_name"`
 	Containers []string `json:"container_name"`
 }
 
+type UserNode struct {
+	NodeName string `json:"node_name"`
+	NodeHost string `json:"node_host"`
+}
+
+type UserGroup struct {
+	GroupName string          `json:"group_name"`
+	Pods      []UserContainer `json:"pods"`
+}
+
+// WithContext returns a copy of api tracing its calls in ctx
+func (api *Api) WithContext(ctx context.Context) *Api {
+	a := *api
+	a.Ctx = ctx
+	return &a
+}
+
+// trace starts a span of a call, the returned func ends it and
+// records the latency and the error
+func (api *Api) trace(method, path string) func(err *error) {
+	start := time.Now()
+	_, span := rlog.Start(api.Ctx, nil, "api", "method", method, "path", path)
+	return func(err *error) {
+		metrics.Since(metrics.ApiDuration.WithLabelValues(method, path), start)
+		if *err != nil {
+			metrics.ApiErrors.WithLabelValues(method, path).Inc()
+		}
+		span.End(*err)
+	}
+}
+
 func (api *Api) Get(path string, data FormData) (err error, ret []byte) {
+	defer api.trace("GET", path)(&err)
 	tokenName := "token"
 	data[tokenName] = data.Sign(api.Secret, tokenName)
 	dataStr := data.URLEncode()
-	log.Println("GetFromURL", api.Base+path, string(dataStr), err)
+	// the query is not logged, it holds the token
+	rlog.Logger.Debug("GetFromURL", "url", api.Base+path)
 
 	if err == nil {
 		var req *http.Request
@@ -51,7 +95,7 @@ func (api *Api) Get(path string, data FormData) (err error, ret []byte) {
 		req, err = http.NewRequest("GET", api.Base+path+"?"+dataStr, nil)
 
 		if err != nil {
-			log.Printf("new request error: %s %s\n", api.Base+path, err.Error())
+			rlog.Logger.Error("new request error", "url", api.Base+path, "error", err)
 			return
 		}
 
@@ -64,7 +108,7 @@ func (api *Api) Get(path string, data FormData) (err error, ret []byte) {
 		}
 		resp, err = client.Do(req)
 		if err != nil {
-			log.Printf("request err %s\n", err.Error())
+			rlog.Logger.Error("request error", "url", api.Base+path, "error", err)
 			return
 		}
 		defer resp.Body.Close()
@@ -79,6 +123,50 @@ func (api *Api) Get(path string, data FormData) (err error, ret []byte) {
 	return
 }
 
+func (api *Api) Post(path string, data FormData) (err error, ret []byte) {
+	defer api.trace("POST", path)(&err)
+	tokenName := "token"
+	data[tokenName] = data.Sign(api.Secret, tokenName)
+	dataStr := data.URLEncode()
+	rlog.Logger.Debug("PostToURL", "url", api.Base+path)
+
+	var req *http.Request
+	var resp *http.Response
+	req, err = http.NewRequest("POST", api.Base+path, strings.NewReader(dataStr))
+	if err != nil {
+		rlog.Logger.Error("new request error", "url", api.Base+path, "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := http.Client{
+		Timeout: time.Second * 10,
+		Transport: &http.Transport{
+			DisableCompression: true,
+		},
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		rlog.Logger.Error("request error", "url", api.Base+path, "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	ret = body
+	if resp.StatusCode != 200 {
+		err = errors.New(string(body))
+		return
+	}
+
+	var ar ApiResp
+	err = json.Unmarshal(ret, &ar)
+	if err == nil && ar.Error != 0 {
+		err = errors.New(ar.Msg)
+	}
+
+	return
+}
+
 func (api *Api) GetKeys(username string) (err error, uks []UserKey) {
 	formData := FormData{
 		"username": username,
@@ -116,3 +204,92 @@ func (api *Api) GetContainers(username string) (err error, ucs []UserContainer)
 
 	return
 }
+
+func (api *Api) GetTOTP(username string) (err error, ut UserTOTP) {
+	formData := FormData{
+		"username": username,
+	}
+
+	e, ret := api.Get("/userinfo/totp", formData)
+	err = e
+	if err != nil {
+		return
+	}
+
+	var ar ApiResp
+	err = json.Unmarshal(ret, &ar)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal([]byte(ar.Data), &ut)
+
+	return
+}
+
+func (api *Api) AddKey(username, title, pubKey string) (err error) {
+	formData := FormData{
+		"username":   username,
+		"title":      title,
+		"public_key": pubKey,
+	}
+
+	err, _ = api.Post("/userinfo/keys/add", formData)
+
+	return
+}
+
+func (api *Api) RemoveKey(username, fingerprint string) (err error) {
+	formData := FormData{
+		"username":    username,
+		"fingerprint": fingerprint,
+	}
+
+	err, _ = api.Post("/userinfo/keys/remove", formData)
+
+	return
+}
+
+func (api *Api) GetNodes(username string) (err error, uns []UserNode) {
+	formData := FormData{
+		"username": username,
+	}
+
+	e, ret := api.Get("/userinfo/nodes", formData)
+	err = e
+	if err != nil {
+		return
+	}
+
+	var ar ApiResp
+	err = json.Unmarshal(ret, &ar)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal([]byte(ar.Data), &uns)
+
+	return
+}
+
+func (api *Api) GetGroups(username string) (err error, ugs []UserGroup) {
+	formData := FormData{
+		"username": username,
+	}
+
+	e, ret := api.Get("/userinfo/groups", formData)
+	err = e
+	if err != nil {
+		return
+	}
+
+	var ar ApiResp
+	err = json.Unmarshal(ret, &ar)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal([]byte(ar.Data), &ugs)
+
+	return
+}
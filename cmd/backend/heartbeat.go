@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wukezhan/rainbow/rlog"
+)
+
+var registries = flag.String("registry", "", "comma separated node registry urls of the relays, e.g. https://relay:9123, needs -tls-cert, disabled if empty")
+var registryToken = flag.String("registry-token", "", "bearer token of the heartbeats and the tunnels")
+var advertise = flag.String("advertise", "", "host:port the relays dial, the hostname and the port of -addr if empty")
+var capacity = flag.Int("capacity", 0, "max of execs reported to the relays, 0 if unlimited")
+var heartbeatInterval = flag.Duration("heartbeat", 10*time.Second, "interval of the heartbeats")
+
+// draining is set on shutdown, the relays route no new session here then
+var draining int32
+
+var (
+	beatOnce   sync.Once
+	beatClient *http.Client
+)
+
+// heartbeat is session.Node, the registry format of the relays
+type heartbeat struct {
+	Name     string          `json:"name"`
+	Addr     string          `json:"addr"`
+	Engines  map[string]bool `json:"engines"`
+	Capacity int             `json:"capacity"`
+	Running  int             `json:"running"`
+	Draining bool            `json:"draining"`
+}
+
+func nodeName() string {
+	if *node != "" {
+		return *node
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+func advertiseAddr() (string, error) {
+	if *advertise != "" {
+		return *advertise, nil
+	}
+	_, port, err := net.SplitHostPort(*addr)
+	if err != nil {
+		return "", err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// checkRegistries refuses the registries that would not know the
+// heartbeats come from this node, they take its certificate as its name
+func checkRegistries() error {
+	if *registries == "" {
+		return nil
+	}
+	if certs == nil {
+		return errors.New("-registry needs -tls-cert")
+	}
+	for _, u := range strings.Split(*registries, ",") {
+		if !strings.HasPrefix(strings.TrimSpace(u), "https://") {
+			return fmt.Errorf("registry %s: https required", u)
+		}
+	}
+	return nil
+}
+
+// sendHeartbeats reports the node to every registry until ctx is done
+func sendHeartbeats(ctx context.Context) {
+	if *registries == "" {
+		return
+	}
+	ticker := time.NewTicker(*heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		beat()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// drainNode tells the registries right away that no new session may come,
+// the tunnels take none either
+func drainNode() {
+	atomic.StoreInt32(&draining, 1)
+	tunnelServers.stop()
+	if *registries != "" {
+		beat()
+	}
+}
+
+// heartbeatClient is the client of every heartbeat, its connections to
+// the registries stay open between the beats. The registries are https,
+// see checkRegistries, certs.Client picks up the reloaded certificate
+func heartbeatClient() *http.Client {
+	beatOnce.Do(func() {
+		beatClient = &http.Client{
+			Timeout: *heartbeatInterval / 2,
+			Transport: &http.Transport{
+				TLSClientConfig: certs.Client(""),
+				IdleConnTimeout: 3 * *heartbeatInterval,
+			},
+		}
+	})
+	return beatClient
+}
+
+// beat sends one heartbeat to every registry
+func beat() {
+	addr, err := advertiseAddr()
+	if err != nil {
+		rlog.Logger.Error("heartbeat address", "error", err)
+		return
+	}
+	client := heartbeatClient()
+	hb := heartbeat{
+		Name:     nodeName(),
+		Addr:     addr,
+		Engines:  map[string]bool{},
+		Capacity: *capacity,
+		Running:  len(running()),
+		Draining: atomic.LoadInt32(&draining) == 1,
+	}
+	for name, h := range engines.Health() {
+		hb.Engines[name] = h.Healthy
+	}
+	data, err := json.Marshal(hb)
+	if err != nil {
+		return
+	}
+	for _, u := range strings.Split(*registries, ",") {
+		u = strings.TrimRight(strings.TrimSpace(u), "/") + "/nodes/heartbeat"
+		err := post(client, u, data)
+		if err != nil {
+			rlog.Logger.Warn("heartbeat", "registry", u, "error", err)
+		}
+	}
+}
+
+func post(client *http.Client, u string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+*registryToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// read to the end, the connection is reused by the next beat
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -1,19 +1,56 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/gorilla/websocket"
+	"github.com/wukezhan/rainbow/metrics"
+	"github.com/wukezhan/rainbow/mtls"
+	"github.com/wukezhan/rainbow/rbac"
+	"github.com/wukezhan/rainbow/rlog"
 	"github.com/wukezhan/rainbow/term"
 )
 
 var addr = flag.String("addr", "0.0.0.0:2356", "http service address")
+var metricsAddr = flag.String("metrics", "127.0.0.1:9125", "address of the /metrics endpoint, it has no auth, disabled if empty")
+var node = flag.String("node", "", "name of this node in the policy and the registries, the hostname if empty, required with -rbac")
+var policyFile = flag.String("rbac", "", "access control policy file, everything is allowed if empty")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long the execs may run after SIGTERM")
+var logLevel = flag.String("log-level", "info", "debug, info, warn or error")
+var logFormat = flag.String("log-format", "text", "text or json")
+var logPayload = flag.Bool("log-payload", false, "log the terminal content, it may hold secrets")
+var tlsCert = flag.String("tls-cert", "", "certificate of this node, issued for its node name, wss with mutual tls if set")
+var tlsKey = flag.String("tls-key", "", "key of -tls-cert")
+var tlsCA = flag.String("tls-ca", "", "ca of the relay and frontend client certificates, not the one of -tls-cert")
+var tlsClients = flag.String("tls-clients", "", "comma separated names allowed in the client certificates, required with -tls-cert")
+var enginesFile = flag.String("engines", "", "docker engines file, the local daemon only if empty")
+var engineCheck = flag.Duration("engine-check", 30*time.Second, "interval of the docker engine health checks")
+var authToken = flag.String("auth-token", "", "token the clients must send as AuthToken in their init message, not checked if empty. With -rbac the clients need it or a -tls-ca certificate")
+var prefsFile = flag.String("preferences", "", "terminal preferences sent to the clients, xterm.js options as json")
+var reconnect = flag.Int("reconnect", 0, "seconds before gotty clients reconnect, disabled if 0")
+var compression = flag.Bool("compression", false, "accept permessage-deflate, the relays are usually on a fast network")
+
+var policy *rbac.Policy
+var engines *term.Engines
+var certs *mtls.Certs
+var prefs []byte
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
@@ -24,34 +61,68 @@ var upgrader = websocket.Upgrader{
 var homeTemplate *template.Template
 
 func pty(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.RequestURI)
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Print("upgrade:", err)
+		rlog.Logger.Warn("upgrade", "error", err)
 		return
 	}
-	defer func() {
-		log.Println("closed")
+	c.SetCompressionLevel(term.Compression)
+	wc := &term.Wc{Conn: c, Proto: c.Subprotocol()}
+	// the relays, gotty and ttyd all send it right after connecting
+	init, err := wc.ReadInit(10 * time.Second)
+	if err != nil {
+		rlog.Logger.Warn("init message", "remote", r.RemoteAddr, "error", err)
 		c.Close()
-	}()
+		return
+	}
+	if *authToken != "" && subtle.ConstantTimeCompare([]byte(init.AuthToken), []byte(*authToken)) != 1 {
+		rlog.Logger.Warn("invalid auth token", "remote", r.RemoteAddr)
+		c.Close()
+		return
+	}
 
 	t := term.New()
-	t.DockerInit("unix:///var/run/docker.sock",
-		"v1.18", nil,
-		map[string]string{"User-Agent": "rainbow-0.0.1"})
 
 	u, _ := url.ParseRequestURI(r.RequestURI)
 	m, _ := url.ParseQuery(u.RawQuery)
+	// gotty sends the query of its page as the arguments
+	args, _ := url.ParseQuery(init.Arguments)
+	for k, v := range args {
+		if _, ok := m[k]; !ok {
+			m[k] = v
+		}
+	}
+	if init.Columns > 0 && init.Rows > 0 && m.Get("cols") == "" {
+		m.Set("cols", strconv.Itoa(init.Columns))
+		m.Set("rows", strconv.Itoa(init.Rows))
+	}
+	t.Session = m.Get("sid")
+	t.Log = rlog.With("session", t.Session, "user", m.Get("user"))
+	t.Ctx = rlog.Remote(t.Ctx, r.Header.Get("traceparent"))
+	t.Log.Info("term", "pod", m.Get("pod"), "name", m.Get("name"), "cmd", m.Get("cmd"), "engine", m.Get("engine"))
+	defer func() {
+		t.Log.Info("term closed")
+		c.Close()
+	}()
+	t.Wc(wc)
+	cli, err := engines.Client(m.Get("engine"))
+	if err != nil {
+		t.Log.Warn("docker engine", "error", err)
+		t.Notice(err.Error())
+		return
+	}
+	t.Client(cli)
+	t.Local = engines.Local(m.Get("engine"))
+	// the initial size of the tty, older relays do not send it
+	t.Cols, _ = strconv.ParseInt(m.Get("cols"), 10, 64)
+	t.Rows, _ = strconv.ParseInt(m.Get("rows"), 10, 64)
 
 	pod := m.Get("pod")
 	name := m.Get("name")
 	if name == "" {
 		return
 	}
-	role := m.Get("role")
-	if role == "" {
-		role = "root"
-	}
+	container := name
 	cmd := m.Get("cmd")
 	if cmd == "" {
 		cmd = "bash"
@@ -61,12 +132,26 @@ func pty(w http.ResponseWriter, r *http.Request) {
 		if err != nil || len(containers) == 0 {
 			return
 		}
-		container := containers[0]
-		name = container.ID
+		name = containers[0].ID
+	}
+	// the user, its groups and role come from the query, they are only
+	// as good as the client sending them
+	trusted := *authToken != "" || (r.TLS != nil && len(r.TLS.VerifiedChains) > 0)
+	d, err := authorize(t, m, trusted, pod, container, name, cmd)
+	if err != nil {
+		t.Log.Warn("rbac denied", "rule", d.Rule, "error", err)
+		t.Notice(err.Error())
+		return
+	}
+	role := d.Role
+	if ttl, err := strconv.Atoi(m.Get("ttl")); err == nil && ttl > 0 {
+		// hard limit of the session, enforced even if the relay goes away
+		t.SetTimeout(time.Duration(ttl) * time.Second)
 	}
 	t.User = m.Get("user")
 	t.Role = role
 	t.SFTP = strings.Contains(cmd, "sftp")
+	t.Writable = !d.ReadOnly
 	ec := &types.ExecConfig{
 		User:         role,
 		AttachStdin:  true,
@@ -75,19 +160,21 @@ func pty(w http.ResponseWriter, r *http.Request) {
 		Tty:          !t.SFTP,
 		Cmd:          []string{cmd},
 	}
+	// tracked once set up, drain reads it from another goroutine
+	track(t, true)
+	defer track(t, false)
 	err = t.DockerExecAttach(name, ec)
 
 	if err == nil {
-		t.Wc(&term.Wc{Conn: c})
 		if !t.SFTP {
-			mt, data, err := c.ReadMessage()
-			if err != nil {
-				return
+			title := container + "@" + nodeName()
+			if pod != "" {
+				title = pod + "/" + title
 			}
-			if mt != websocket.TextMessage {
+			err = t.SendInit(title, prefs, *reconnect)
+			if err != nil {
 				return
 			}
-			log.Println(string(data), "in")
 		}
 
 		t.Start()
@@ -98,9 +185,210 @@ func pty(w http.ResponseWriter, r *http.Request) {
 	c.Close()
 }
 
+// authorize checks the exec against the policy, with the labels of the
+// container. The identity in m is refused unless trusted
+func authorize(t *term.DockerTty, m url.Values, trusted bool, pod, container, id, cmd string) (d rbac.Decision, err error) {
+	if policy != nil && !trusted {
+		d.Reason = "unauthenticated client"
+		return d, errors.New("permission denied: " + d.Reason)
+	}
+	req := rbac.Request{
+		User:      m.Get("user"),
+		Node:      *node,
+		Pod:       pod,
+		Container: container,
+		Role:      m.Get("role"),
+		Cmd:       cmd,
+		Mode:      rbac.ModeTTY,
+	}
+	if strings.Contains(cmd, "sftp") {
+		req.Mode = rbac.ModeSFTP
+	}
+	if m.Get("groups") != "" {
+		req.Groups = strings.Split(m.Get("groups"), ",")
+	}
+	if policy != nil {
+		var cname string
+		cname, req.Labels, err = t.DockerInspect(id)
+		if err != nil {
+			return
+		}
+		if pod == "" {
+			// the rules match the name, not an id or a prefix of it
+			req.Container = cname
+		}
+	}
+	d = policy.Decide(req)
+	if !d.Allowed {
+		err = errors.New("permission denied: " + d.Reason)
+	}
+	return
+}
+
+// ttys are the running execs, for the shutdown
+var ttys = struct {
+	sync.Mutex
+	m map[*term.DockerTty]struct{}
+}{m: map[*term.DockerTty]struct{}{}}
+
+func track(t *term.DockerTty, add bool) {
+	ttys.Lock()
+	defer ttys.Unlock()
+	if add {
+		ttys.m[t] = struct{}{}
+	} else {
+		delete(ttys.m, t)
+	}
+}
+
+func running() []*term.DockerTty {
+	ttys.Lock()
+	defer ttys.Unlock()
+	ts := make([]*term.DockerTty, 0, len(ttys.m))
+	for t := range ttys.m {
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+// drain notifies the execs and waits for them until ctx is done, the
+// remaining ones are cancelled then, which kills their processes
+func drain(ctx context.Context, msg string) {
+	for _, t := range running() {
+		t.Notice(msg)
+	}
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	done := ctx.Done()
+	var grace <-chan time.Time
+	for len(running()) > 0 {
+		select {
+		case <-ticker.C:
+		case <-done:
+			done = nil
+			for _, t := range running() {
+				t.Log.Info("exec cancelled by shutdown")
+				t.Notice("[rainbow] the node shut down")
+				t.Close()
+			}
+			// give the cancelled execs a moment to be killed
+			grace = time.After(5 * time.Second)
+		case <-grace:
+			return
+		}
+	}
+}
+
+// health reports the last check of the docker engines, it fails if the
+// engine asked, or every one without engine=, is unhealthy
+func health(w http.ResponseWriter, r *http.Request) {
+	hs := engines.Health()
+	healthy := false
+	if name := r.URL.Query().Get("engine"); name != "" {
+		h, ok := hs[name]
+		if !ok {
+			http.Error(w, "unknown docker engine "+name, http.StatusNotFound)
+			return
+		}
+		healthy = h.Healthy
+	} else {
+		for _, h := range hs {
+			healthy = healthy || h.Healthy
+		}
+	}
+	data, err := json.Marshal(hs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(data)
+}
+
+// tlsNames are the client names allowed by -tls-clients
+func tlsNames() []string {
+	return strings.Split(*tlsClients, ",")
+}
+
 func main() {
 	log.SetFlags(log.Lshortfile)
 	flag.Parse()
+	if err := rlog.Setup(*logLevel, *logFormat, *logPayload); err != nil {
+		log.Fatal(err)
+	}
+	upgrader.EnableCompression = *compression
+	if *policyFile != "" {
+		if *node == "" {
+			log.Fatal("-rbac needs -node, the policy is not checked against a name the clients send")
+		}
+		var err error
+		policy, err = rbac.Load(*policyFile)
+		if err != nil {
+			log.Fatal("load rbac policy: ", err)
+		}
+	}
+	var err error
+	prefs, err = term.LoadPreferences(*prefsFile)
+	if err != nil {
+		log.Fatal("load preferences: ", err)
+	}
+	engines, err = term.LoadEngines(*enginesFile)
+	if err != nil {
+		log.Fatal("load docker engines: ", err)
+	}
+	checkCtx, stopCheck := context.WithCancel(context.Background())
+	defer stopCheck()
+	// the api versions are negotiated before the first exec
+	engines.Check(*engineCheck / 2)
+	go engines.Watch(checkCtx, *engineCheck)
+	if *tlsCert != "" {
+		if *tlsClients == "" {
+			log.Fatal("-tls-cert needs -tls-clients, the names of the relays and frontends")
+		}
+		certs, err = mtls.Load(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatal("load certificates: ", err)
+		}
+		// rotated certificates are picked up without a restart
+		go certs.Watch(checkCtx, time.Minute)
+	}
+	if err := checkTunnels(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkRegistries(); err != nil {
+		log.Fatal(err)
+	}
 	http.HandleFunc("/term", pty)
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	// gotty and ttyd dial ws next to their page
+	http.HandleFunc("/ws", pty)
+	http.HandleFunc("/health", health)
+	metrics.Serve(*metricsAddr)
+	go sendHeartbeats(checkCtx)
+	keepTunnels(checkCtx, http.DefaultServeMux)
+	srv := &http.Server{Addr: *addr}
+	go func() {
+		var err error
+		if certs != nil {
+			srv.TLSConfig = certs.Server(tlsNames())
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	rlog.Logger.Info("shutting down", "signal", <-sig)
+	ctx, cf := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cf()
+	drainNode()
+	// the websockets are hijacked, Shutdown does not wait for them
+	srv.Shutdown(ctx)
+	drain(ctx, fmt.Sprintf("[rainbow] the node is shutting down, please save your work, this session ends in %s", *shutdownTimeout))
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/wukezhan/rainbow/rlog"
+)
+
+var tunnelURLs = flag.String("tunnel", "", "comma separated relay urls to keep a reverse tunnel open to, e.g. https://relay:9123, for nodes the relays can not dial, needs -tls-cert")
+
+// tunnelUpgrade is session.TunnelUpgrade
+const tunnelUpgrade = "rainbow-tunnel"
+
+// tunnelMaxBackoff is the longest wait between two reconnections
+const tunnelMaxBackoff = 30 * time.Second
+
+// bufConn reads what the response reader buffered first
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// checkTunnels refuses the tunnels the relays can not tie to this node,
+// they take its certificate over https as its name
+func checkTunnels() error {
+	if *tunnelURLs == "" {
+		return nil
+	}
+	if certs == nil {
+		return errors.New("-tunnel needs -tls-cert")
+	}
+	for _, u := range strings.Split(*tunnelURLs, ",") {
+		if !strings.HasPrefix(strings.TrimSpace(u), "https://") {
+			return fmt.Errorf("tunnel %s: https required", u)
+		}
+	}
+	return nil
+}
+
+// keepTunnels keeps a tunnel open to every relay until ctx is done
+func keepTunnels(ctx context.Context, handler http.Handler) {
+	if *tunnelURLs == "" {
+		return
+	}
+	for _, u := range strings.Split(*tunnelURLs, ",") {
+		go keepTunnel(ctx, strings.TrimSpace(u), handler)
+	}
+}
+
+// keepTunnel reconnects with an exponential backoff, reset once a tunnel
+// held for a minute
+func keepTunnel(ctx context.Context, u string, handler http.Handler) {
+	log := rlog.With("relay", u)
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := serveTunnel(ctx, u, handler)
+		if ctx.Err() != nil || err == http.ErrServerClosed {
+			// the node drains, the tunnel stays up for its execs
+			return
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		log.Warn("tunnel lost", "error", err, "retry", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > tunnelMaxBackoff {
+			backoff = tunnelMaxBackoff
+		}
+	}
+}
+
+// serveTunnel dials the relay and serves the execs it opens as streams
+// until the tunnel breaks
+func serveTunnel(ctx context.Context, rawURL string, handler http.Handler) error {
+	u, err := url.Parse(strings.TrimRight(rawURL, "/") + "/tunnel")
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	// the node certificate is the name of the tunnel, see checkTunnels
+	conn, err := tls.DialWithDialer(d, "tcp", host, certs.Client(u.Hostname()))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", tunnelUpgrade)
+	req.Header.Set("Authorization", "Bearer "+*registryToken)
+	req.Header.Set("X-Rainbow-Node", nodeName())
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return errors.New(resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// the relay opens the streams, we accept them
+	ts, err := yamux.Server(bufConn{Conn: conn, r: br}, nil)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	rlog.Logger.Info("tunnel open", "relay", rawURL)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-ts.CloseChan():
+		}
+		ts.Close()
+	}()
+	// the execs are mutual tls inside the tunnel too
+	l := tls.NewListener(&tunnelListener{Session: ts, closed: make(chan struct{})}, certs.Server(tlsNames()))
+	// a server per tunnel, stopped with the main one by drainNode, the
+	// tunnelled execs are left to drain
+	srv := &http.Server{Handler: handler}
+	if !tunnelServers.add(srv) {
+		ts.Close()
+		return http.ErrServerClosed
+	}
+	defer tunnelServers.remove(srv)
+	return srv.Serve(l)
+}
+
+// tunnelListener accepts the streams of a tunnel, closing it leaves the
+// tunnel open for the streams of the running execs
+type tunnelListener struct {
+	*yamux.Session
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	conn, err := l.Session.Accept()
+	select {
+	case <-l.closed:
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, net.ErrClosed
+	default:
+	}
+	return conn, err
+}
+
+func (l *tunnelListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// servers are the http servers of the open tunnels
+type servers struct {
+	m       map[*http.Server]struct{}
+	stopped bool
+	lock    sync.Mutex
+}
+
+var tunnelServers = &servers{m: map[*http.Server]struct{}{}}
+
+// add registers srv, false once stopped
+func (s *servers) add(srv *http.Server) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.m[srv] = struct{}{}
+	return true
+}
+
+func (s *servers) remove(srv *http.Server) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.m, srv)
+}
+
+// stop closes the servers, the tunnels take no new exec. The hijacked
+// websockets of the running ones are not closed
+func (s *servers) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopped = true
+	for srv := range s.m {
+		srv.Close()
+	}
+}
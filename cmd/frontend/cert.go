@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wukezhan/rainbow/api"
+	"github.com/wukezhan/rainbow/pkey"
+	"github.com/wukezhan/rainbow/ratelimit"
+	"github.com/wukezhan/rainbow/rlog"
+	"golang.org/x/crypto/ssh"
+)
+
+var secret = flag.String("secret", "", "secret used to check the signed token, /cert is disabled without it")
+var caKey = flag.String("ca", "./conf/ca.id_rsa", "ssh user ca private key")
+var certMaxTTL = flag.Duration("cert-max-ttl", 24*time.Hour, "max ttl of issued certificates")
+var certAudit = flag.String("cert-audit", "./cert_audit.log", "audit log of issued certificates")
+
+var caSigner ssh.Signer
+var auditLock sync.Mutex
+
+// Cert .
+type Cert struct {
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"private_key,omitempty"`
+	PublicKey   string `json:"public_key,omitempty"`
+	Serial      uint64 `json:"serial"`
+	ValidBefore int64  `json:"valid_before"`
+}
+
+// checkToken checks the token signed by the api, same as the websocket one
+func checkToken(m url.Values) bool {
+	if m.Get("token") == "" {
+		return false
+	}
+	if *secret == "" {
+		return true
+	}
+	data := api.FormData{}
+	for k := range m {
+		data[k] = m.Get(k)
+	}
+	return data.Check(*secret, "token")
+}
+
+func loadCA() {
+	if *secret == "" {
+		// any token passes without a secret, no certificate is minted then
+		rlog.Logger.Warn("ca key not loaded, /cert disabled", "error", "-secret not set")
+		return
+	}
+	signer, err := pkey.LoadSigner(*caKey)
+	if err != nil {
+		rlog.Logger.Warn("ca key not loaded, /cert disabled", "error", err)
+		return
+	}
+	caSigner = signer
+}
+
+func audit(user string, r *http.Request, record pkey.CertRecord) {
+	rlog.Logger.Info("cert issued", "user", user, "serial", record.Serial, "fingerprint", record.FingerPrint, "remote", r.RemoteAddr)
+	entry := struct {
+		pkey.CertRecord
+		User     string `json:"user"`
+		RemoteIP string `json:"remote_ip"`
+		IssuedAt int64  `json:"issued_at"`
+	}{
+		CertRecord: record,
+		User:       user,
+		RemoteIP:   r.RemoteAddr,
+		IssuedAt:   time.Now().Unix(),
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	f, err := os.OpenFile(*certAudit, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		rlog.Logger.Error("cert audit", "user", user, "serial", record.Serial, "error", err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
+
+func cert(w http.ResponseWriter, r *http.Request) {
+	if caSigner == nil || *secret == "" {
+		http.Error(w, "ca not configured", http.StatusServiceUnavailable)
+		return
+	}
+	ip := ratelimit.Host(r.RemoteAddr)
+	if ok, wait := limiter.Allow("cert", ip, ""); !ok {
+		throttled(w, wait)
+		return
+	}
+	r.ParseForm()
+	m := r.Form
+	if !checkToken(m) {
+		limiter.Fail("cert", ip, "")
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+	user := m.Get("user")
+	if user == "" {
+		http.Error(w, "user required", http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Hour
+	if m.Get("ttl") != "" {
+		d, err := time.ParseDuration(m.Get("ttl"))
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	if ttl > *certMaxTTL {
+		ttl = *certMaxTTL
+	}
+	var exts []string
+	if m.Get("ext") != "" {
+		exts = strings.Split(m.Get("ext"), ",")
+		if err := pkey.CheckExtensions(exts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var resp Cert
+	var pub ssh.PublicKey
+	if m.Get("pubkey") != "" {
+		var err error
+		pub, _, _, _, err = ssh.ParseAuthorizedKey([]byte(m.Get("pubkey")))
+		if err != nil {
+			http.Error(w, "invalid public key", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if m.Get("alg") == "" {
+			// unlike /key there is no older client relying on rsa
+			m.Set("alg", pkey.Ed25519)
+		}
+		if r.URL.Query().Get("passphrase") != "" {
+			http.Error(w, "post the passphrase in the body", http.StatusBadRequest)
+			return
+		}
+		pk, signer, err := genKey(m, r.PostForm.Get("passphrase"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pub, err = ssh.NewPublicKey(signer.Public())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.PrivateKey = pk.PrivateKey
+		resp.PublicKey = pk.PublicKey
+	}
+
+	c, err := pkey.SignUserCert(caSigner, pub, pkey.CertOptions{
+		KeyID:      user,
+		Principals: []string{user},
+		TTL:        ttl,
+		Extensions: exts,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(user, r, pkey.NewCertRecord(c))
+
+	resp.Certificate = string(ssh.MarshalAuthorizedKey(c))
+	resp.Serial = c.Serial
+	resp.ValidBefore = int64(c.ValidBefore)
+	cb, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	w.Write(cb)
+}
@@ -1,17 +1,31 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/wukezhan/rainbow/metrics"
+	"github.com/wukezhan/rainbow/mtls"
 	"github.com/wukezhan/rainbow/pkey"
+	"github.com/wukezhan/rainbow/ratelimit"
+	"github.com/wukezhan/rainbow/rbac"
+	"github.com/wukezhan/rainbow/rlog"
 	sess "github.com/wukezhan/rainbow/session"
 
 	"github.com/gorilla/websocket"
@@ -19,6 +33,30 @@ import (
 )
 
 var addr = flag.String("addr", "0.0.0.0:9999", "http service address")
+var metricsAddr = flag.String("metrics", "127.0.0.1:9124", "address of the /metrics endpoint, it has no auth, disabled if empty")
+var timeouts = flag.String("timeouts", "", "idle and max session duration policy file")
+var policyFile = flag.String("rbac", "", "access control policy file, everything is allowed if empty")
+var logLevel = flag.String("log-level", "info", "debug, info, warn or error")
+var logFormat = flag.String("log-format", "text", "text or json")
+var logPayload = flag.Bool("log-payload", false, "log the terminal content, it may hold secrets")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long the sessions may run after SIGTERM")
+var adminToken = flag.String("admin-token", "", "bearer token of the admin api under /admin/, disabled if empty")
+var nodeToken = flag.String("node-token", "", "bearer token of the backend heartbeats under /nodes/ and tunnels under /tunnel, they also need a -backend-ca certificate of their node name, the node registry is disabled if empty")
+var nodeAddr = flag.String("node-addr", "0.0.0.0:9123", "tls address of the node registry and the tunnels")
+var nodeCert = flag.String("node-cert", "", "certificate of -node-addr, issued by the -tls-ca of the backends")
+var nodeKey = flag.String("node-key", "", "key of -node-cert")
+var nodeTTL = flag.Duration("node-ttl", 30*time.Second, "how long a backend is up after its last heartbeat")
+var backendCert = flag.String("backend-cert", "", "client certificate to the backends, they are dialed with wss and mutual tls if set")
+var backendKey = flag.String("backend-key", "", "key of -backend-cert")
+var backendCA = flag.String("backend-ca", "", "ca of the backend certificates, issued for their node names, not the one of -backend-cert")
+var rateLimit = flag.String("ratelimit", "", "login rate limit config, the defaults are used if empty")
+var guardFile = flag.String("guard", "", "dangerous command rules of the interactive input, disabled if empty")
+var backendToken = flag.String("backend-token", "", "auth token sent to the backends in the init message")
+var prefsFile = flag.String("preferences", "", "terminal preferences sent to the clients, xterm.js options as json")
+var reconnect = flag.Int("reconnect", 0, "seconds before gotty clients reconnect, disabled if 0")
+var compression = flag.Bool("compression", true, "offer permessage-deflate to the browsers")
+var lockFile = flag.String("lock-file", "./locks.json", "locked users, shared with the relays given the same file, in memory only if empty")
+var backendCompression = flag.Bool("backend-compression", false, "offer permessage-deflate to the backends")
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
@@ -28,25 +66,81 @@ var upgrader = websocket.Upgrader{
 
 var homeTemplate *template.Template
 
-func pubkey(w http.ResponseWriter, r *http.Request) {
-	bitSize := 4096
+var limiter *ratelimit.Limiter
+
+var prefs []byte
 
-	privateKey, err := pkey.GeneratePrivateKey(bitSize)
+// genKey generates a key pair as requested by alg, bits and format, an rsa
+// key in PKCS#1 PEM by default. The private key is encrypted with
+// passphrase in the OpenSSH format if it is not empty
+func genKey(m url.Values, passphrase string) (pk pkey.Pkey, signer crypto.Signer, err error) {
+	alg := m.Get("alg")
+	if alg == "" {
+		alg = pkey.RSA
+	}
+	bits := 0
+	if m.Get("bits") != "" {
+		bits, err = strconv.Atoi(m.Get("bits"))
+		if err != nil {
+			return
+		}
+		if alg == pkey.RSA && (bits < 2048 || bits > 8192) {
+			err = errors.New("invalid rsa key size")
+			return
+		}
+	}
+
+	signer, err = pkey.GenerateKey(alg, bits)
 	if err != nil {
-		log.Fatal(err.Error())
+		return
 	}
 
-	publicKeyBytes, err := pkey.GeneratePublicKey(&privateKey.PublicKey)
+	publicKeyBytes, err := pkey.MarshalPublicKey(signer.Public())
 	if err != nil {
-		log.Fatal(err.Error())
+		return
 	}
 
-	privateKeyBytes := pkey.EncodePrivateKeyToPEM(privateKey)
+	var privateKeyBytes []byte
+	if rsaKey, ok := signer.(*rsa.PrivateKey); ok && m.Get("format") != "openssh" && passphrase == "" {
+		privateKeyBytes = pkey.EncodePrivateKeyToPEM(rsaKey)
+	} else {
+		privateKeyBytes, err = pkey.EncodePrivateKeyToOpenSSH(signer, m.Get("comment"), []byte(passphrase))
+		if err != nil {
+			return
+		}
+	}
 
-	pk := pkey.Pkey{
+	pk = pkey.Pkey{
 		PrivateKey: string(privateKeyBytes),
 		PublicKey:  string(publicKeyBytes),
 	}
+	pk.FingerPrint, err = pkey.FingerprintSHA256(publicKeyBytes)
+	return
+}
+
+// throttled refuses the request, the client may retry after wait
+func throttled(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
+
+func pubkey(w http.ResponseWriter, r *http.Request) {
+	// key generation is expensive, rsa 8192 in particular
+	if ok, wait := limiter.Allow("key", ratelimit.Host(r.RemoteAddr), ""); !ok {
+		throttled(w, wait)
+		return
+	}
+	r.ParseForm()
+	// urls end up in the logs and the history, the passphrase is posted
+	if r.URL.Query().Get("passphrase") != "" {
+		http.Error(w, "post the passphrase in the body", http.StatusBadRequest)
+		return
+	}
+	pk, _, err := genKey(r.Form, r.PostForm.Get("passphrase"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	pkb, err := json.Marshal(pk)
 	if err != nil {
@@ -56,37 +150,63 @@ func pubkey(w http.ResponseWriter, r *http.Request) {
 }
 
 func echo(w http.ResponseWriter, r *http.Request) {
+	ip := ratelimit.Host(r.RemoteAddr)
+	if blocked, wait := limiter.Blocked("ws", ip, ""); blocked {
+		throttled(w, wait)
+		return
+	}
 	ic, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Print("upgrade:", err)
+		rlog.Logger.Warn("upgrade", "remote", r.RemoteAddr, "error", err)
 		return
 	}
 	defer func() {
-		log.Println("ic closed")
+		rlog.Logger.Debug("ic closed", "remote", r.RemoteAddr)
 		ic.Close()
 	}()
+	ic.SetCompressionLevel(term.Compression)
 
-	mt, data, err := ic.ReadMessage()
+	// gotty sends it as text, ttyd as binary
+	_, data, err := ic.ReadMessage()
 	if err != nil {
 		return
 	}
-	if mt != websocket.TextMessage {
+	init, err := term.ParseInit(data)
+	if err != nil {
 		return
 	}
-
-	var postData map[string]string
-	json.Unmarshal(data, &postData)
-	rawQuery := strings.TrimLeft(postData["Arguments"], "?")
+	rawQuery := init.Arguments
+	if rawQuery == "" {
+		// ttyd keeps the query of its page in the url
+		rawQuery = r.URL.RawQuery
+	}
 	m, _ := url.ParseQuery(rawQuery)
+	if m.Get("token") == "" && init.AuthToken != "" {
+		m.Set("token", init.AuthToken)
+	}
 
-	if m.Get("token") == "" {
+	if ok, _ := limiter.Allow("ws", ip, m.Get("user")); !ok {
+		ic.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too many attempts"))
+		return
+	}
+	ok := checkToken(m)
+	metrics.Auth.WithLabelValues("token", metrics.Result(ok)).Inc()
+	if !ok {
+		limiter.Fail("ws", ip, m.Get("user"))
 		return
 	}
+	limiter.Success("ws", ip, m.Get("user"))
 	name := m.Get("name")
 	user := m.Get("user")
 	if user == "" {
 		return
 	}
+	if sess.Locked(user) {
+		ic.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "user locked"))
+		return
+	}
 	role := m.Get("role")
 	if role == "" {
 		role = "root"
@@ -97,7 +217,8 @@ func echo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sws := &sess.WsSess{
-		Ws: ic,
+		Ws:    ic,
+		Proto: ic.Subprotocol(),
 	}
 	uid, err := strconv.Atoi(m.Get("uid"))
 	ss := sess.New()
@@ -106,16 +227,37 @@ func echo(w http.ResponseWriter, r *http.Request) {
 		ID:   uid,
 		Name: user,
 	}
+	ss.Log = ss.Log.With("user", user)
+	ss.RemoteIP = r.RemoteAddr
 	sws.Sess = ss
 	ss.UIO = sws
+	if sws.Handshake(init, title(m), prefs, *reconnect) != nil {
+		return
+	}
 	if name == "" {
 		ss.Relay()
 	} else {
 		ss.Mode = sess.TTY
 		ss.TTY(m)
+		ss.Exit()
 	}
 }
 
+// title is the window title, the container as pod/name@node or the relay
+func title(m url.Values) string {
+	if m.Get("name") == "" {
+		return "relay@rainbow"
+	}
+	t := m.Get("name")
+	if m.Get("node") != "" {
+		t += "@" + m.Get("node")
+	}
+	if m.Get("pod") != "" {
+		t = m.Get("pod") + "/" + t
+	}
+	return t
+}
+
 func home(w http.ResponseWriter, r *http.Request) {
 	uri := strings.Split(r.RequestURI, "?")
 	if uri[0] == "/" {
@@ -128,11 +270,94 @@ func home(w http.ResponseWriter, r *http.Request) {
 func main() {
 	flag.Parse()
 	log.SetFlags(log.Llongfile | log.Ltime | log.LstdFlags)
+	upgrader.EnableCompression = *compression
+	sess.BackendCompression = *backendCompression
+	sess.LockFile = *lockFile
+	if err := rlog.Setup(*logLevel, *logFormat, *logPayload); err != nil {
+		log.Fatal(err)
+	}
+	var err error
+	prefs, err = term.LoadPreferences(*prefsFile)
+	if err != nil {
+		log.Fatal("load preferences: ", err)
+	}
+	sess.BackendToken = *backendToken
+	limiter, err = ratelimit.Load(*rateLimit)
+	if err != nil {
+		log.Fatal("load rate limits: ", err)
+	}
+	if *backendCert != "" {
+		var err error
+		sess.BackendTLS, err = mtls.Load(*backendCert, *backendKey, *backendCA)
+		if err != nil {
+			log.Fatal("load backend certificates: ", err)
+		}
+		// rotated certificates are picked up without a restart
+		go sess.BackendTLS.Watch(context.Background(), time.Minute)
+	}
+	if *guardFile != "" {
+		var err error
+		sess.Guards, err = sess.LoadGuards(*guardFile)
+		if err != nil {
+			log.Fatal("load guard rules: ", err)
+		}
+	}
+	if *policyFile != "" {
+		var err error
+		sess.Policy, err = rbac.Load(*policyFile)
+		if err != nil {
+			log.Fatal("load rbac policy: ", err)
+		}
+	}
+	if *timeouts != "" {
+		var err error
+		sess.Timeouts, err = sess.LoadTimeouts(*timeouts)
+		if err != nil {
+			log.Fatal("load timeouts: ", err)
+		}
+	}
 	fTpl, _ := ioutil.ReadFile("./app/index.html")
 	homeTemplate = template.Must(template.New("").Parse(string(fTpl)))
+	loadCA()
 	http.Handle("/static/", http.StripPrefix("/", http.FileServer(http.Dir("./app/"))))
 	http.HandleFunc("/ws", echo)
 	http.HandleFunc("/key", pubkey)
+	http.HandleFunc("/cert", cert)
+	metrics.Serve(*metricsAddr)
+	if *adminToken != "" {
+		http.Handle("/admin/", sess.AdminHandler(*adminToken))
+	}
+	if *nodeToken != "" {
+		sess.Nodes = sess.NewNodeRegistry(*nodeTTL)
+		certs, err := mtls.Load(*nodeCert, *nodeKey, *backendCA)
+		if err != nil {
+			log.Fatal("load node certificates: ", err)
+		}
+		go certs.Watch(context.Background(), time.Minute)
+		// off the public port, the backends present their node certificates
+		mux := http.NewServeMux()
+		mux.Handle("/nodes/", sess.NodesHandler(sess.Nodes, *nodeToken))
+		mux.Handle("/tunnel", sess.TunnelHandler(*nodeToken))
+		nodes := &http.Server{Addr: *nodeAddr, Handler: mux, TLSConfig: certs.Peer(), IdleTimeout: time.Minute}
+		go func() {
+			rlog.Logger.Error("nodes server", "error", nodes.ListenAndServeTLS("", ""))
+		}()
+	}
 	http.HandleFunc("/", home)
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	srv := &http.Server{Addr: *addr}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	rlog.Logger.Info("shutting down", "signal", <-sig)
+	ctx, cf := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cf()
+	// the websockets are hijacked, Shutdown does not wait for them
+	srv.Shutdown(ctx)
+	sess.Shutdown(ctx, fmt.Sprintf("the server is shutting down, please save your work, this session ends in %s", *shutdownTimeout))
 }
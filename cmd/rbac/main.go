@@ -0,0 +1,67 @@
+// rbac evaluates a policy file offline, e.g.
+//
+//	rbac -policy conf/rbac.json -user alice -groups dev -node node1 -pod web -container app -cmd bash
+//
+// it prints the decision and exits with 1 when denied
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wukezhan/rainbow/rbac"
+)
+
+var (
+	policy    = flag.String("policy", "./conf/rbac.json", "policy file")
+	user      = flag.String("user", "", "user name")
+	groups    = flag.String("groups", "", "comma separated groups of the user")
+	node      = flag.String("node", "", "node name")
+	pod       = flag.String("pod", "", "pod name")
+	container = flag.String("container", "", "container name")
+	labels    = flag.String("labels", "", "k=v,k2=v2 labels of the container and its image, unset means unknown")
+	role      = flag.String("role", "", "exec user, empty for the default one")
+	cmd       = flag.String("cmd", "bash", "command")
+	mode      = flag.String("mode", rbac.ModeTTY, "tty or sftp")
+	at        = flag.String("time", "", "RFC3339 time of the request, now if empty")
+)
+
+func main() {
+	flag.Parse()
+	p, err := rbac.Load(*policy)
+	if err != nil {
+		log.Fatal("load policy: ", err)
+	}
+	req := rbac.Request{
+		User:      *user,
+		Node:      *node,
+		Pod:       *pod,
+		Container: *container,
+		Role:      *role,
+		Cmd:       *cmd,
+		Mode:      *mode,
+	}
+	if *groups != "" {
+		req.Groups = strings.Split(*groups, ",")
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "labels" {
+			req.Labels = rbac.ParseLabels(*labels)
+		}
+	})
+	if *at != "" {
+		req.Time, err = time.Parse(time.RFC3339, *at)
+		if err != nil {
+			log.Fatal("invalid time: ", err)
+		}
+	}
+	d := p.Decide(req)
+	fmt.Println(d)
+	if !d.Allowed {
+		os.Exit(1)
+	}
+}
@@ -3,23 +3,113 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/wukezhan/rainbow/api"
+	"github.com/wukezhan/rainbow/metrics"
+	"github.com/wukezhan/rainbow/mtls"
+	"github.com/wukezhan/rainbow/ratelimit"
+	"github.com/wukezhan/rainbow/rbac"
+	"github.com/wukezhan/rainbow/rlog"
 	sess "github.com/wukezhan/rainbow/session"
 	"github.com/wukezhan/ssh"
 )
 
+var timeouts = flag.String("timeouts", "", "idle and max session duration policy file")
+var policyFile = flag.String("rbac", "", "access control policy file, everything is allowed if empty")
+var metricsAddr = flag.String("metrics", "127.0.0.1:9122", "address of the /metrics endpoint, it has no auth, disabled if empty")
+var logLevel = flag.String("log-level", "info", "debug, info, warn or error")
+var logFormat = flag.String("log-format", "text", "text or json")
+var logPayload = flag.Bool("log-payload", false, "log the terminal content, it may hold secrets")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long the sessions may run after SIGTERM")
+var adminAddr = flag.String("admin", "", "address of the admin api and the node registry, served with tls, disabled if empty")
+var adminCert = flag.String("admin-cert", "", "certificate of the -admin listener, issued by the -tls-ca of the backends")
+var adminKey = flag.String("admin-key", "", "key of -admin-cert")
+var adminToken = flag.String("admin-token", "", "bearer token of the admin api")
+var nodeToken = flag.String("node-token", "", "bearer token of the backend heartbeats and tunnels, they also need a -backend-ca certificate of their node name, the node registry is disabled if empty")
+var nodeTTL = flag.Duration("node-ttl", 30*time.Second, "how long a backend is up after its last heartbeat")
+var backendCert = flag.String("backend-cert", "", "client certificate to the backends, they are dialed with wss and mutual tls if set")
+var backendKey = flag.String("backend-key", "", "key of -backend-cert")
+var backendCA = flag.String("backend-ca", "", "ca of the backend certificates, issued for their node names, not the one of -backend-cert")
+var rateLimit = flag.String("ratelimit", "", "login rate limit config, the defaults are used if empty")
+var guardFile = flag.String("guard", "", "dangerous command rules of the interactive input, disabled if empty")
+
+// userKeysKey caches the keys of the user on the ssh context
+var userKeysKey = &struct{ name string }{"user-keys"}
+
+// keyFailedKey is set once a connection offered a wrong key
+var keyFailedKey = &struct{ name string }{"key-failed"}
+
+var limiter *ratelimit.Limiter
+
+// checkKey checks key against the keys of the user, second is set when
+// the user must pass the second factor after it
+func checkKey(ctx ssh.Context, key ssh.PublicKey) (ok bool, second bool) {
+	username := ctx.User()
+	if sess.Locked(username) {
+		metrics.Auth.WithLabelValues("publickey", "locked").Inc()
+		return false, false
+	}
+	ip := ratelimit.Host(ctx.RemoteAddr().String())
+	// clients offer their keys one by one, the keys are fetched once
+	// per connection and only its first mismatch counts as a failure
+	uks, fetched := ctx.Value(userKeysKey).([]api.UserKey)
+	if !fetched {
+		if ok, wait := limiter.Allow("publickey", ip, username); !ok {
+			rlog.Logger.Warn("throttled", "user", username, "remote", ip, "wait", wait)
+			return false, false
+		}
+		var err error
+		err, uks = api.New().GetKeys(username)
+		if err != nil {
+			metrics.Auth.WithLabelValues("publickey", metrics.Result(false)).Inc()
+			return false, false
+		}
+		ctx.SetValue(userKeysKey, uks)
+	}
+	for _, uk := range uks {
+		allowed, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(uk.PubKey))
+		if !ssh.KeysEqual(key, allowed) {
+			continue
+		}
+		if needMFA(ctx, key) {
+			metrics.Auth.WithLabelValues("publickey", "mfa").Inc()
+			return true, true
+		}
+		metrics.Auth.WithLabelValues("publickey", metrics.Result(true)).Inc()
+		limiter.Success("publickey", ip, username)
+		return true, false
+	}
+	metrics.Auth.WithLabelValues("publickey", metrics.Result(false)).Inc()
+	if ctx.Value(keyFailedKey) == nil {
+		ctx.SetValue(keyFailedKey, true)
+		limiter.Fail("publickey", ip, username)
+	}
+	return false, false
+}
+
 func main() {
 	log.SetFlags(log.Lshortfile | log.Ldate | log.Ltime)
 	ssh.Handle(func(s ssh.Session) {
-		log.Print("user ", s.User(), " in ")
 		_, winCh, isPty := s.Pty()
 		ss := sess.New()
 		ss.Kind = "ssh"
 		ss.User = sess.User{
 			Name: s.User(),
+			Key:  s.PublicKey(),
 		}
+		ss.Log = ss.Log.With("user", s.User())
+		ss.RemoteIP = s.RemoteAddr().String()
+		ss.Log.Info("user in", "remote", s.RemoteAddr().String(), "pty", isPty)
+		// `ssh -t user@relay <alias>` goes straight to the alias
+		ss.Cmd = strings.Join(s.Command(), " ")
 		sss := &sess.SSHSess{
 			Ss:   s,
 			Sess: ss,
@@ -41,35 +131,17 @@ func main() {
 			cf()
 		} else {
 			subsys := s.SubSys()
-			log.Println("subsys", subsys)
+			ss.Log.Info("subsys", "subsys", subsys)
 			if subsys == "sftp" {
 				ss.SFTP()
 			}
-			log.Println("no-pty", s.Command())
+			ss.Log.Info("no-pty", "command", s.Command())
 			//io.WriteString(s, "No PTY requested.\n")
 			s.Exit(1)
+			ss.Exit()
 		}
 	})
 
-	publicKeyOption := ssh.PublicKeyAuth(func(ctx ssh.Context, key ssh.PublicKey) bool {
-		username := ctx.User()
-		ra := api.New()
-		err, uks := ra.GetKeys(username)
-		ul := len(uks)
-		if err == nil && ul > 0 {
-			i := 0
-			for i < ul {
-				uk := uks[i]
-				allowed, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(uk.PubKey))
-				if ssh.KeysEqual(key, allowed) {
-					//log.Println("true", key)
-					return true
-				}
-				i++
-			}
-		}
-		return false // allow all keys, or use ssh.KeysEqual() to compare against known keys
-	})
 	/*passwordOption := ssh.PasswordAuth(func(ctx ssh.Context, password string) bool {
 		username := ctx.User()
 		log.Println("password", username, password)
@@ -80,8 +152,106 @@ func main() {
 
 	var ip string
 	flag.StringVar(&ip, "ip", "172.16.165.137", "listen ip")
+	flag.StringVar(&sess.ProfileDir, "profile-dir", "./profiles", "per user history, favourites and aliases, empty to keep them in memory")
+	flag.IntVar(&sess.HistoryLimit, "history-limit", 1000, "max history lines per user")
+	flag.StringVar(&sess.BackendToken, "backend-token", "", "auth token sent to the backends in the init message")
+	flag.StringVar(&sess.LockFile, "lock-file", "./locks.json", "locked users, shared with the frontends given the same file, in memory only if empty")
+	flag.BoolVar(&sess.BackendCompression, "backend-compression", false, "offer permessage-deflate to the backends")
 	flag.Parse()
+	if err := rlog.Setup(*logLevel, *logFormat, *logPayload); err != nil {
+		log.Fatal(err)
+	}
+	initMFA()
+	var err error
+	limiter, err = ratelimit.Load(*rateLimit)
+	if err != nil {
+		log.Fatal("load rate limits: ", err)
+	}
+	if *backendCert != "" {
+		var err error
+		sess.BackendTLS, err = mtls.Load(*backendCert, *backendKey, *backendCA)
+		if err != nil {
+			log.Fatal("load backend certificates: ", err)
+		}
+		// rotated certificates are picked up without a restart
+		go sess.BackendTLS.Watch(context.Background(), time.Minute)
+	}
+	if *guardFile != "" {
+		var err error
+		sess.Guards, err = sess.LoadGuards(*guardFile)
+		if err != nil {
+			log.Fatal("load guard rules: ", err)
+		}
+	}
+	if *policyFile != "" {
+		var err error
+		sess.Policy, err = rbac.Load(*policyFile)
+		if err != nil {
+			log.Fatal("load rbac policy: ", err)
+		}
+	}
+	if *timeouts != "" {
+		var err error
+		sess.Timeouts, err = sess.LoadTimeouts(*timeouts)
+		if err != nil {
+			log.Fatal("load timeouts: ", err)
+		}
+	}
+
+	options := []ssh.Option{hostKeyOption /*, passwordOption*/}
+
+	metrics.Serve(*metricsAddr)
+
+	if *nodeToken != "" {
+		sess.Nodes = sess.NewNodeRegistry(*nodeTTL)
+	}
+	if *adminAddr != "" && *adminToken == "" {
+		log.Fatal("-admin needs -admin-token")
+	}
+	if *nodeToken != "" && *adminAddr == "" {
+		log.Fatal("-node-token needs -admin, the node registry is served there")
+	}
+	if *adminAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/admin/", sess.AdminHandler(*adminToken))
+		if *nodeToken != "" {
+			mux.Handle("/nodes/", sess.NodesHandler(sess.Nodes, *nodeToken))
+			mux.Handle("/tunnel", sess.TunnelHandler(*nodeToken))
+		}
+		// the backends present their node certificates, the admin api
+		// takes the token alone
+		certs, err := mtls.Load(*adminCert, *adminKey, *backendCA)
+		if err != nil {
+			log.Fatal("load admin certificates: ", err)
+		}
+		go certs.Watch(context.Background(), time.Minute)
+		admin := &http.Server{Addr: *adminAddr, Handler: mux, TLSConfig: certs.Peer(), IdleTimeout: time.Minute}
+		go func() {
+			rlog.Logger.Error("admin server", "error", admin.ListenAndServeTLS("", ""))
+		}()
+	}
+
+	srv := &ssh.Server{Addr: ip + ":22", ServerConfigCallback: serverConfig}
+	for _, option := range options {
+		if err := srv.SetOption(option); err != nil {
+			log.Fatal(err)
+		}
+	}
+	go func() {
+		rlog.Logger.Info("starting ssh server", "addr", ip+":22")
+		err := srv.ListenAndServe()
+		if err != ssh.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 
-	log.Println("starting ssh server on port " + ip + ":22..")
-	log.Fatal(ssh.ListenAndServe(ip+":22", nil, publicKeyOption, hostKeyOption /*, passwordOption*/))
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	rlog.Logger.Info("shutting down", "signal", <-sig)
+	ctx, cf := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cf()
+	// stop accepting, the sessions are drained below
+	go srv.Shutdown(ctx)
+	sess.Shutdown(ctx, fmt.Sprintf("the relay is shutting down, please save your work, this session ends in %s", *shutdownTimeout))
+	srv.Close()
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"time"
+
+	"github.com/wukezhan/rainbow/api"
+	"github.com/wukezhan/rainbow/metrics"
+	"github.com/wukezhan/rainbow/mfa"
+	"github.com/wukezhan/rainbow/ratelimit"
+	"github.com/wukezhan/rainbow/rlog"
+	"github.com/wukezhan/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var env = flag.String("env", "", "environment served by this relay, matched against the mfa policy")
+var mfaPolicy = flag.String("mfa-policy", "", "two-factor policy file, empty to disable")
+var mfaStore = flag.String("mfa-store", "", "local totp secret file, empty to fetch from the api")
+
+const mfaAttempts = 3
+
+var policy *mfa.Policy
+var store mfa.Store
+
+// usedCodes keeps a totp code from being replayed within its window
+var usedCodes = mfa.NewUsed()
+
+var errDenied = errors.New("permission denied")
+
+func initMFA() {
+	if *mfaPolicy == "" {
+		return
+	}
+	var err error
+	policy, err = mfa.LoadPolicy(*mfaPolicy)
+	if err != nil {
+		log.Fatal("load mfa policy: ", err)
+	}
+	if *mfaStore != "" {
+		store, err = mfa.LoadFileStore(*mfaStore)
+		if err != nil {
+			log.Fatal("load mfa store: ", err)
+		}
+	} else {
+		store = &mfa.APIStore{Api: api.New()}
+	}
+}
+
+func deviceOf(ctx ssh.Context, key ssh.PublicKey) string {
+	host, _, err := net.SplitHostPort(ctx.RemoteAddr().String())
+	if err != nil {
+		host = ctx.RemoteAddr().String()
+	}
+	return ctx.User() + "|" + gossh.FingerprintSHA256(key) + "|" + host
+}
+
+// needMFA tells if the user must pass the second factor after the public key,
+// it fails closed when the secret can not be fetched
+func needMFA(ctx ssh.Context, key ssh.PublicKey) bool {
+	if policy == nil {
+		return false
+	}
+	// no rate limit here, false lets the key in alone. The public key
+	// and the code are throttled by their own callbacks
+	username := ctx.User()
+	secret, err := store.Get(username)
+	if err != nil && err != mfa.ErrNoSecret {
+		rlog.Logger.Error("mfa secret", "user", username, "error", err)
+		return true
+	}
+	if !policy.Required(*env, username, secret.Groups) {
+		return false
+	}
+	return !policy.Remembered(deviceOf(ctx, key))
+}
+
+// serverConfig does the auth instead of the handlers of the ssh package,
+// which can not tell the public key queries from the signed requests: a
+// second factor pending after a query would let a client holding only
+// the public key in with the code. The code is asked through a partial
+// success, which x/crypto only grants once the signature is verified
+func serverConfig(ctx ssh.Context) *gossh.ServerConfig {
+	return &gossh.ServerConfig{
+		// the ssh package turns NoClientAuth on when it has no handler,
+		// none must fail all the same
+		NoClientAuthCallback: func(conn gossh.ConnMetadata) (*gossh.Permissions, error) {
+			return nil, errDenied
+		},
+		PublicKeyCallback: func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			connMetadata(ctx, conn)
+			perms := ctx.Permissions().Permissions
+			ok, second := checkKey(ctx, key)
+			if !ok {
+				return perms, errDenied
+			}
+			if second {
+				return perms, &gossh.PartialSuccessError{Next: gossh.ServerAuthCallbacks{
+					KeyboardInteractiveCallback: func(conn gossh.ConnMetadata, challenger gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+						if !keyboardInteractive(ctx, key, challenger) {
+							return perms, errDenied
+						}
+						ctx.SetValue(ssh.ContextKeyPublicKey, key)
+						return perms, nil
+					},
+				}}
+			}
+			ctx.SetValue(ssh.ContextKeyPublicKey, key)
+			return perms, nil
+		},
+	}
+}
+
+// connMetadata sets what the handlers of the ssh package set on ctx
+func connMetadata(ctx ssh.Context, conn gossh.ConnMetadata) {
+	if ctx.Value(ssh.ContextKeySessionID) != nil {
+		return
+	}
+	ctx.SetValue(ssh.ContextKeySessionID, hex.EncodeToString(conn.SessionID()))
+	ctx.SetValue(ssh.ContextKeyClientVersion, string(conn.ClientVersion()))
+	ctx.SetValue(ssh.ContextKeyServerVersion, string(conn.ServerVersion()))
+	ctx.SetValue(ssh.ContextKeyUser, conn.User())
+	ctx.SetValue(ssh.ContextKeyLocalAddr, conn.LocalAddr())
+	ctx.SetValue(ssh.ContextKeyRemoteAddr, conn.RemoteAddr())
+}
+
+// keyboardInteractive asks the totp code of the user, whose key passed
+func keyboardInteractive(ctx ssh.Context, key ssh.PublicKey, challenger gossh.KeyboardInteractiveChallenge) bool {
+	username := ctx.User()
+	if ok, _ := limiter.Allow("keyboard-interactive", ratelimit.Host(ctx.RemoteAddr().String()), username); !ok {
+		return false
+	}
+	secret, err := store.Get(username)
+	if err != nil {
+		rlog.Logger.Error("mfa secret", "user", username, "error", err)
+		return false
+	}
+	for i := 0; i < mfaAttempts; i++ {
+		answers, err := challenger(username, "two-factor authentication",
+			[]string{"verification code: "}, []bool{true})
+		if err != nil {
+			return false
+		}
+		if len(answers) != 1 {
+			continue
+		}
+		step, ok := mfa.Step(secret.Secret, answers[0], time.Now())
+		if ok && usedCodes.Claim(username, step) {
+			rlog.Logger.Info("mfa passed", "user", username, "remote", ctx.RemoteAddr().String())
+			metrics.Auth.WithLabelValues("keyboard-interactive", metrics.Result(true)).Inc()
+			policy.Remember(deviceOf(ctx, key))
+			return true
+		}
+		rlog.Logger.Warn("mfa failed", "user", username, "remote", ctx.RemoteAddr().String())
+	}
+	metrics.Auth.WithLabelValues("keyboard-interactive", metrics.Result(false)).Inc()
+	limiter.Fail("keyboard-interactive", ratelimit.Host(ctx.RemoteAddr().String()), username)
+	return false
+}
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/wukezhan/rainbow/rlog"
+)
+
+// directions of the relayed bytes
+const (
+	// In is from the user to the container
+	In = "in"
+	// Out is from the container to the user
+	Out = "out"
+)
+
+var (
+	// Auth counts the logins by method and result
+	Auth = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rainbow_auth_total",
+		Help: "Authentication attempts by method and result.",
+	}, []string{"method", "result"})
+
+	// ApiDuration .
+	ApiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rainbow_api_request_duration_seconds",
+		Help:    "Latency of the api calls by path.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "path"})
+
+	// ApiErrors .
+	ApiErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rainbow_api_errors_total",
+		Help: "Failed api calls by path.",
+	}, []string{"method", "path"})
+
+	// DialErrors counts the failed connections to the backends
+	DialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rainbow_backend_dial_errors_total",
+		Help: "Failed dials to the backend by node.",
+	}, []string{"node"})
+
+	// ExecDuration is the docker exec create and attach latency
+	ExecDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rainbow_exec_duration_seconds",
+		Help:    "Latency of the docker exec steps.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"step"})
+
+	// ExecErrors .
+	ExecErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rainbow_exec_errors_total",
+		Help: "Failed docker exec steps.",
+	}, []string{"step"})
+
+	// EngineUp is 1 if the last health check of the docker engine passed
+	EngineUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rainbow_docker_engine_up",
+		Help: "Health of the docker engines of the backend.",
+	}, []string{"engine"})
+
+	// Throttled counts the login attempts refused by the rate limiter
+	Throttled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rainbow_throttled_total",
+		Help: "Login attempts refused by endpoint and reason, rate, penalty or ban.",
+	}, []string{"endpoint", "reason"})
+
+	// Bans counts the temporary bans of an ip or a user
+	Bans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rainbow_bans_total",
+		Help: "Temporary bans by endpoint.",
+	}, []string{"endpoint"})
+
+	// Bytes relayed between the users and the containers
+	Bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rainbow_bytes_total",
+		Help: "Bytes relayed by direction, in is user to container.",
+	}, []string{"direction"})
+)
+
+func init() {
+	prometheus.MustRegister(Auth, ApiDuration, ApiErrors, DialErrors, ExecDuration, ExecErrors, EngineUp, Throttled, Bans, Bytes)
+}
+
+// Result labels ok as a success or a failure
+func Result(ok bool) string {
+	if ok {
+		return "success"
+	}
+	return "failure"
+}
+
+// Since observes the time since start
+func Since(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
+
+// Handler serves /metrics, the go runtime ones, e.g. go_goroutines, included
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Serve serves /metrics alone on addr, off the public ports, unless addr
+// is empty
+func Serve(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	go func() {
+		rlog.Logger.Error("metrics server", "addr", addr, "error", http.ListenAndServe(addr, mux))
+	}()
+}
@@ -0,0 +1,100 @@
+package mfa
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// Policy decides who must pass the second factor
+type Policy struct {
+	// Users and Groups enforced, "*" matches everyone
+	Users  []string `json:"users"`
+	Groups []string `json:"groups"`
+	// Envs enforced, empty means every environment
+	Envs []string `json:"envs"`
+	// Remember is the remember-device window, e.g. "12h"
+	RememberFor string `json:"remember"`
+
+	remember time.Duration
+	devices  map[string]time.Time
+	lock     sync.Mutex
+}
+
+// LoadPolicy .
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	err = json.Unmarshal(data, p)
+	if err != nil {
+		return nil, err
+	}
+	if p.RememberFor != "" {
+		p.remember, err = time.ParseDuration(p.RememberFor)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.devices = map[string]time.Time{}
+	return p, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s || v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Required .
+func (p *Policy) Required(env, username string, groups []string) bool {
+	if p == nil {
+		return false
+	}
+	if len(p.Envs) > 0 && !contains(p.Envs, env) {
+		return false
+	}
+	if contains(p.Users, username) {
+		return true
+	}
+	for _, g := range groups {
+		if contains(p.Groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remembered reports if the device passed the second factor within the window
+func (p *Policy) Remembered(device string) bool {
+	if p == nil || p.remember == 0 {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	t, ok := p.devices[device]
+	if !ok {
+		return false
+	}
+	if time.Since(t) > p.remember {
+		delete(p.devices, device)
+		return false
+	}
+	return true
+}
+
+// Remember marks the device as verified
+func (p *Policy) Remember(device string) {
+	if p == nil || p.remember == 0 {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.devices[device] = time.Now()
+}
@@ -0,0 +1,71 @@
+package mfa
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+
+	"github.com/wukezhan/rainbow/api"
+)
+
+// ErrNoSecret is returned when the user has no second factor enrolled
+var ErrNoSecret = errors.New("no totp secret")
+
+// Secret .
+type Secret struct {
+	Secret string   `json:"secret"`
+	Groups []string `json:"groups"`
+}
+
+// Store looks up the totp secret of a user
+type Store interface {
+	Get(username string) (Secret, error)
+}
+
+// FileStore is a local store, loaded from a json file of username => Secret
+type FileStore struct {
+	secrets map[string]Secret
+}
+
+// LoadFileStore .
+func LoadFileStore(path string) (*FileStore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fs := &FileStore{}
+	err = json.Unmarshal(data, &fs.secrets)
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Get .
+func (fs *FileStore) Get(username string) (Secret, error) {
+	s, ok := fs.secrets[username]
+	if !ok || s.Secret == "" {
+		return s, ErrNoSecret
+	}
+	return s, nil
+}
+
+// APIStore fetches secrets from the api
+type APIStore struct {
+	Api *api.Api
+}
+
+// Get .
+func (as *APIStore) Get(username string) (Secret, error) {
+	err, ut := as.Api.GetTOTP(username)
+	if err != nil {
+		return Secret{}, err
+	}
+	if ut.Secret == "" {
+		return Secret{}, ErrNoSecret
+	}
+	return Secret{
+		Secret: ut.Secret,
+		Groups: ut.Groups,
+	}, nil
+}
@@ -0,0 +1,98 @@
+package mfa
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Period is the TOTP time step
+const Period = 30
+
+// Digits is the length of a TOTP code
+const Digits = 6
+
+// Skew is the number of steps accepted before and after now
+const Skew = 1
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+}
+
+func hotp(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	h := hmac.New(sha1.New, key)
+	h.Write(msg)
+	sum := h.Sum(nil)
+
+	// dynamic truncation, RFC 4226 5.3
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%1000000)
+}
+
+// Code returns the TOTP code of secret at t
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(t.Unix())/Period), nil
+}
+
+// Validate checks code against secret, allowing Skew steps of clock drift
+func Validate(secret, code string, t time.Time) bool {
+	_, ok := Step(secret, code, t)
+	return ok
+}
+
+// Step returns the time step code is valid for, within Skew steps of t
+func Step(secret, code string, t time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, false
+	}
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+	counter := int64(t.Unix()) / Period
+	for i := -Skew; i <= Skew; i++ {
+		expected := hotp(key, uint64(counter+int64(i)))
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return counter + int64(i), true
+		}
+	}
+	return 0, false
+}
+
+// Used is the last step accepted per user, a code is good once only
+// (RFC 6238 5.2), including within the skew window
+type Used struct {
+	steps map[string]int64
+	lock  sync.Mutex
+}
+
+// NewUsed .
+func NewUsed() *Used {
+	return &Used{steps: map[string]int64{}}
+}
+
+// Claim records step for username, false if it, or a later step, was
+// accepted already
+func (u *Used) Claim(username string, step int64) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if last, ok := u.steps[username]; ok && step <= last {
+		return false
+	}
+	u.steps[username] = step
+	return true
+}
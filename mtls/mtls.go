@@ -0,0 +1,208 @@
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wukezhan/rainbow/rlog"
+)
+
+// Certs are the certificate, key and CA files of one side, reloaded when
+// they change so that they can be rotated without a restart. The CA is the
+// one of the other side, it must not have issued the certificate: with a
+// shared CA any node could pass for a relay to the other nodes
+type Certs struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+
+	cert *tls.Certificate
+	pool *x509.CertPool
+	mod  time.Time
+	lock sync.RWMutex
+}
+
+// Load .
+func Load(certFile, keyFile, caFile string) (*Certs, error) {
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("mtls needs a certificate, a key and a ca")
+	}
+	c := &Certs{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   caFile,
+	}
+	_, err := c.Reload()
+	return c, err
+}
+
+// modTime is the latest change of the files
+func (c *Certs) modTime() (time.Time, error) {
+	var mod time.Time
+	for _, f := range []string{c.CertFile, c.KeyFile, c.CAFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return mod, err
+		}
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+	return mod, nil
+}
+
+// Reload reads the files again if one of them changed, the current ones
+// are kept if the new ones are invalid
+func (c *Certs) Reload() (bool, error) {
+	mod, err := c.modTime()
+	if err != nil {
+		return false, err
+	}
+	c.lock.RLock()
+	same := mod.Equal(c.mod)
+	c.lock.RUnlock()
+	if same {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	pem, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return false, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return false, fmt.Errorf("no certificate in %s", c.CAFile)
+	}
+	if issued(cert, pool) {
+		return false, fmt.Errorf("%s is issued by %s, the ca of the other side", c.CertFile, c.CAFile)
+	}
+	c.lock.Lock()
+	c.cert, c.pool, c.mod = &cert, pool, mod
+	c.lock.Unlock()
+	return true, nil
+}
+
+// Watch reloads the files every interval until ctx is done
+func (c *Certs) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ok, err := c.Reload()
+			if err != nil {
+				rlog.Logger.Warn("tls reload", "cert", c.CertFile, "error", err)
+			} else if ok {
+				rlog.Logger.Info("tls reloaded", "cert", c.CertFile)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// issued reports if the pool verifies cert
+func issued(cert tls.Certificate, pool *x509.CertPool) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	inter := x509.NewCertPool()
+	for _, der := range cert.Certificate[1:] {
+		if c, err := x509.ParseCertificate(der); err == nil {
+			inter.AddCert(c)
+		}
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err == nil
+}
+
+func (c *Certs) current() (*tls.Certificate, *x509.CertPool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, c.pool
+}
+
+// Client is the config to dial a backend, its certificate must be issued
+// by the CA for serverName, the node name, whatever host it is reached at
+func (c *Certs) Client(serverName string) *tls.Config {
+	_, pool := c.current()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		RootCAs:    pool,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := c.current()
+			return cert, nil
+		},
+	}
+}
+
+// Server is the config of a backend, the clients need a client certificate
+// of the CA with one of names as common name or DNS name
+func (c *Certs) Server(names []string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := c.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					return Allowed(cs.PeerCertificates[0], names)
+				},
+			}, nil
+		},
+	}
+}
+
+// Peer is the config of a relay listener the backends connect to, e.g.
+// the node registry: the clients without a certificate pass the
+// handshake, those with one must hold a certificate of the CA. The
+// handlers check the name of the certificate where they need one
+func (c *Certs) Peer() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := c.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+			}, nil
+		},
+	}
+}
+
+// Allowed checks cert was issued for one of names, as common name or DNS
+// name. No cert is allowed if names is empty
+func Allowed(cert *x509.Certificate, names []string) error {
+	for _, name := range names {
+		if cert.Subject.CommonName == name {
+			return nil
+		}
+		for _, dns := range cert.DNSNames {
+			if dns == name {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("client certificate %s not allowed", cert.Subject.CommonName)
+}
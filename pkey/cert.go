@@ -0,0 +1,146 @@
+package pkey
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultExtensions is the extension set granted when none is requested
+var DefaultExtensions = []string{
+	"permit-pty",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+}
+
+// Extensions are the extensions a certificate may carry, the permit-*
+// ones of OpenSSH. Critical options are never granted
+var Extensions = []string{
+	"permit-X11-forwarding",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+	"permit-pty",
+	"permit-user-rc",
+}
+
+// CheckExtensions refuses the extensions out of Extensions
+func CheckExtensions(exts []string) error {
+	for _, ext := range exts {
+		ok := false
+		for _, allowed := range Extensions {
+			ok = ok || ext == allowed
+		}
+		if !ok {
+			return fmt.Errorf("extension %q not allowed", ext)
+		}
+	}
+	return nil
+}
+
+// CertOptions .
+type CertOptions struct {
+	KeyID      string
+	Principals []string
+	TTL        time.Duration
+	Extensions []string
+}
+
+// CertRecord describes an issued certificate, used for audit
+type CertRecord struct {
+	Serial      uint64   `json:"serial"`
+	KeyID       string   `json:"key_id"`
+	Principals  []string `json:"principals"`
+	Extensions  []string `json:"extensions"`
+	FingerPrint string   `json:"fingerprint"`
+	ValidAfter  int64    `json:"valid_after"`
+	ValidBefore int64    `json:"valid_before"`
+}
+
+// LoadSigner reads a CA private key from file
+func LoadSigner(path string) (ssh.Signer, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(pemBytes)
+}
+
+// SignUserCert signs pub with the ca key as a user certificate
+func SignUserCert(ca ssh.Signer, pub ssh.PublicKey, opts CertOptions) (*ssh.Certificate, error) {
+	if len(opts.Principals) == 0 {
+		return nil, errors.New("no principals")
+	}
+	if opts.TTL <= 0 {
+		return nil, errors.New("invalid ttl")
+	}
+	serial, err := randSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	exts := opts.Extensions
+	if exts == nil {
+		exts = DefaultExtensions
+	}
+	if err := CheckExtensions(exts); err != nil {
+		return nil, err
+	}
+	permissions := ssh.Permissions{
+		Extensions: map[string]string{},
+	}
+	for _, ext := range exts {
+		permissions.Extensions[ext] = ""
+	}
+
+	// tolerate small clock skew between the frontend and the servers
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           opts.KeyID,
+		ValidPrincipals: opts.Principals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(opts.TTL).Unix()),
+		Permissions:     permissions,
+	}
+	err = cert.SignCert(rand.Reader, ca)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// NewCertRecord .
+func NewCertRecord(cert *ssh.Certificate) CertRecord {
+	exts := make([]string, 0, len(cert.Extensions))
+	for ext := range cert.Extensions {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return CertRecord{
+		Serial:      cert.Serial,
+		KeyID:       cert.KeyId,
+		Principals:  cert.ValidPrincipals,
+		Extensions:  exts,
+		FingerPrint: ssh.FingerprintSHA256(cert.Key),
+		ValidAfter:  int64(cert.ValidAfter),
+		ValidBefore: int64(cert.ValidBefore),
+	}
+}
+
+func randSerial() (uint64, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
@@ -0,0 +1,139 @@
+package pkey
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Key algorithms
+const (
+	RSA     = "rsa"
+	ECDSA   = "ecdsa"
+	Ed25519 = "ed25519"
+)
+
+// ErrUnknownAlgorithm .
+var ErrUnknownAlgorithm = errors.New("unknown key algorithm")
+
+// GenerateKey creates a private key of alg, bits is ignored by ed25519
+// and defaults to 4096 for rsa and 256 for ecdsa
+func GenerateKey(alg string, bits int) (crypto.Signer, error) {
+	switch alg {
+	case RSA:
+		if bits == 0 {
+			bits = 4096
+		}
+		return GeneratePrivateKey(bits)
+	case ECDSA:
+		var curve elliptic.Curve
+		switch bits {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("invalid ecdsa key size %d", bits)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	return nil, ErrUnknownAlgorithm
+}
+
+// EncodePrivateKeyToOpenSSH encodes a private key in the OpenSSH format,
+// the key is encrypted when passphrase is not empty
+func EncodePrivateKeyToOpenSSH(key crypto.PrivateKey, comment string, passphrase []byte) ([]byte, error) {
+	var block *pem.Block
+	var err error
+	if len(passphrase) > 0 {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, comment, passphrase)
+	} else {
+		block, err = ssh.MarshalPrivateKey(key, comment)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// ParsePrivateKey parses a PEM (PKCS#1, PKCS#8, SEC1) or OpenSSH private key,
+// passphrase is only used for encrypted keys
+func ParsePrivateKey(pemBytes, passphrase []byte) (crypto.Signer, error) {
+	var key interface{}
+	var err error
+	if len(passphrase) > 0 {
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, passphrase)
+	} else {
+		key, err = ssh.ParseRawPrivateKey(pemBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	case *ed25519.PrivateKey:
+		return *k, nil
+	}
+	return nil, ErrUnknownAlgorithm
+}
+
+// MarshalPublicKey returns bytes suitable for writing to .pub file
+func MarshalPublicKey(pub crypto.PublicKey) ([]byte, error) {
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.MarshalAuthorizedKey(sshPub), nil
+}
+
+// FingerprintSHA256 returns the "SHA256:..." fingerprint of an authorized key line
+func FingerprintSHA256(authorizedKey []byte) (string, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(authorizedKey)
+	if err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(pub), nil
+}
+
+// FingerprintMD5 returns the legacy "aa:bb:..." fingerprint of an authorized key line
+func FingerprintMD5(authorizedKey []byte) (string, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(authorizedKey)
+	if err != nil {
+		return "", err
+	}
+	return ssh.FingerprintLegacyMD5(pub), nil
+}
+
+// FingerprintMatch compares fp, in either the SHA256 or the (optionally
+// "MD5:" prefixed) legacy format, with the fingerprint of pub
+func FingerprintMatch(fp string, pub ssh.PublicKey) bool {
+	fp = strings.TrimSpace(fp)
+	if strings.HasPrefix(fp, "SHA256:") {
+		return fp == ssh.FingerprintSHA256(pub)
+	}
+	fp = strings.ToLower(strings.TrimPrefix(fp, "MD5:"))
+	return fp == ssh.FingerprintLegacyMD5(pub) || fp == fmt.Sprintf("%x", md5.Sum(pub.Marshal()))
+}
@@ -5,15 +5,15 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
-	"log"
 
 	"golang.org/x/crypto/ssh"
 )
 
 // Pkey .
 type Pkey struct {
-	PrivateKey string `json:"private_key"`
-	PublicKey  string `json:"public_key"`
+	PrivateKey  string `json:"private_key"`
+	PublicKey   string `json:"public_key"`
+	FingerPrint string `json:"fingerprint,omitempty"`
 }
 
 // GeneratePrivateKey creates a RSA Private Key of specified byte size
@@ -30,7 +30,6 @@ func GeneratePrivateKey(bitSize int) (*rsa.PrivateKey, error) {
 		return nil, err
 	}
 
-	log.Println("Private Key generated")
 	return privateKey, nil
 }
 
@@ -64,6 +63,5 @@ func GeneratePublicKey(privatekey *rsa.PublicKey) ([]byte, error) {
 
 	pubKeyBytes := ssh.MarshalAuthorizedKey(publicRsaKey)
 
-	log.Println("Public key generated")
 	return pubKeyBytes, nil
 }
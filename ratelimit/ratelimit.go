@@ -0,0 +1,323 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wukezhan/rainbow/metrics"
+)
+
+// reasons of a refused attempt
+const (
+	Rate    = "rate"
+	Penalty = "penalty"
+	Ban     = "ban"
+)
+
+// pruneEvery is how often the idle entries are dropped
+const pruneEvery = time.Minute
+
+// Config of a Limiter, durations are like "1s" or "1h"
+type Config struct {
+	// Rate is the attempts per second of an ip or a user on an endpoint,
+	// Burst the attempts allowed at once
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	// Penalty is the wait after the first failure, it doubles with every
+	// following one up to MaxPenalty
+	Penalty    string `json:"penalty"`
+	MaxPenalty string `json:"max_penalty"`
+	// BanAfter failures in a row the ip is banned for BanFor, 0 disables
+	// the bans. The failures only penalize the ip and the ip with the
+	// user, anyone could lock the user out otherwise
+	BanAfter int    `json:"ban_after"`
+	BanFor   string `json:"ban_for"`
+	// Allow are the trusted networks in CIDR notation, never limited
+	Allow []string `json:"allow"`
+
+	penalty    time.Duration
+	maxPenalty time.Duration
+	banFor     time.Duration
+}
+
+// Default is used without a config file
+var Default = Config{
+	Rate:       1,
+	Burst:      10,
+	Penalty:    "1s",
+	MaxPenalty: "5m",
+	BanAfter:   20,
+	BanFor:     "1h",
+	Allow:      []string{"127.0.0.0/8", "::1/128"},
+}
+
+type entry struct {
+	tokens float64
+	last   time.Time
+	fails  int
+	// until is the end of the penalty or the ban
+	until  time.Time
+	banned bool
+}
+
+// Limiter throttles the login attempts by ip and by user
+type Limiter struct {
+	cfg     Config
+	allow   []*net.IPNet
+	entries map[string]*entry
+	pruned  time.Time
+	lock    sync.Mutex
+	// now is time.Now but in the tests
+	now func() time.Time
+}
+
+// Load reads the config from file, the defaults are used if file is empty
+func Load(file string) (*Limiter, error) {
+	cfg := Default
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return New(cfg)
+}
+
+// New .
+func New(cfg Config) (*Limiter, error) {
+	var err error
+	for _, d := range []struct {
+		s string
+		d *time.Duration
+	}{{cfg.Penalty, &cfg.penalty}, {cfg.MaxPenalty, &cfg.maxPenalty}, {cfg.BanFor, &cfg.banFor}} {
+		if d.s == "" {
+			continue
+		}
+		*d.d, err = time.ParseDuration(d.s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l := &Limiter{
+		cfg:     cfg,
+		entries: map[string]*entry{},
+		pruned:  time.Now(),
+		now:     time.Now,
+	}
+	for _, cidr := range cfg.Allow {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		l.allow = append(l.allow, n)
+	}
+	return l, nil
+}
+
+// Host strips the port of a remote address
+func Host(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Trusted reports if ip is in an allowed network
+func (l *Limiter) Trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range l.allow {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// bucket is the key of an entry, soft ones are rate limited but never
+// penalized or banned
+type bucket struct {
+	key  string
+	soft bool
+}
+
+// buckets of an attempt of ip and user on endpoint: the ip, the ip with the
+// user and the user alone
+func buckets(endpoint, ip, user string) []bucket {
+	user = strings.ToLower(user)
+	bs := []bucket{}
+	if ip != "" {
+		bs = append(bs, bucket{key: endpoint + " ip:" + ip})
+	}
+	if ip != "" && user != "" {
+		bs = append(bs, bucket{key: endpoint + " ip:" + ip + " user:" + user})
+	}
+	if user != "" {
+		bs = append(bs, bucket{key: endpoint + " user:" + user, soft: true})
+	}
+	return bs
+}
+
+// blocked returns why e refuses attempts at now, "" if it does not
+func (e *entry) blocked(now time.Time) string {
+	if !now.Before(e.until) {
+		return ""
+	}
+	if e.banned {
+		return Ban
+	}
+	return Penalty
+}
+
+// Blocked reports if ip or ip with user is penalized or banned on endpoint,
+// it does not count as an attempt
+func (l *Limiter) Blocked(endpoint, ip, user string) (bool, time.Duration) {
+	if l == nil || l.Trusted(ip) {
+		return false, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	for _, b := range buckets(endpoint, ip, user) {
+		if e, ok := l.entries[b.key]; ok && e.blocked(now) != "" {
+			return true, e.until.Sub(now)
+		}
+	}
+	return false, 0
+}
+
+// Allow counts an attempt of ip and user on endpoint, it returns false and
+// how long to wait if a bucket is over its rate, penalized or banned
+func (l *Limiter) Allow(endpoint, ip, user string) (bool, time.Duration) {
+	if l == nil || l.Trusted(ip) {
+		return true, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	l.prune(now)
+	bs := buckets(endpoint, ip, user)
+	es := make([]*entry, len(bs))
+	for i, b := range bs {
+		e := l.entry(b.key, now)
+		if reason := e.blocked(now); reason != "" {
+			metrics.Throttled.WithLabelValues(endpoint, reason).Inc()
+			return false, e.until.Sub(now)
+		}
+		e.tokens += now.Sub(e.last).Seconds() * l.cfg.Rate
+		if e.tokens > float64(l.cfg.Burst) {
+			e.tokens = float64(l.cfg.Burst)
+		}
+		e.last = now
+		es[i] = e
+	}
+	for _, e := range es {
+		if e.tokens < 1 {
+			metrics.Throttled.WithLabelValues(endpoint, Rate).Inc()
+			wait := time.Second
+			if l.cfg.Rate > 0 {
+				wait = time.Duration((1 - e.tokens) / l.cfg.Rate * float64(time.Second))
+			}
+			return false, wait
+		}
+	}
+	for _, e := range es {
+		e.tokens--
+	}
+	return true, 0
+}
+
+func (l *Limiter) entry(key string, now time.Time) *entry {
+	e, ok := l.entries[key]
+	if !ok {
+		e = &entry{tokens: float64(l.cfg.Burst), last: now}
+		l.entries[key] = e
+	}
+	return e
+}
+
+// Fail records a failed login of ip and user on endpoint, the penalty of
+// the ip and of the ip with the user doubles with every failure in a row
+// and turns into a ban after BanAfter of them
+func (l *Limiter) Fail(endpoint, ip, user string) {
+	if l == nil || l.Trusted(ip) {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	for _, b := range buckets(endpoint, ip, user) {
+		if b.soft {
+			continue
+		}
+		e := l.entry(b.key, now)
+		e.fails++
+		if l.cfg.BanAfter > 0 && e.fails >= l.cfg.BanAfter {
+			if !e.banned {
+				metrics.Bans.WithLabelValues(endpoint).Inc()
+			}
+			e.banned = true
+			e.until = now.Add(l.cfg.banFor)
+			continue
+		}
+		e.until = now.Add(l.penalty(e.fails))
+	}
+}
+
+// penalty is the wait after fails failures in a row
+func (l *Limiter) penalty(fails int) time.Duration {
+	penalty := l.cfg.penalty
+	for i := 1; i < fails && i < 32; i++ {
+		penalty *= 2
+		if l.cfg.maxPenalty > 0 && penalty >= l.cfg.maxPenalty {
+			return l.cfg.maxPenalty
+		}
+	}
+	return penalty
+}
+
+// Success clears the failures of ip and user on endpoint
+func (l *Limiter) Success(endpoint, ip, user string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	for _, b := range buckets(endpoint, ip, user) {
+		if e, ok := l.entries[b.key]; ok && e.blocked(now) == "" {
+			e.fails = 0
+			e.until = time.Time{}
+			e.banned = false
+		}
+	}
+}
+
+// prune drops the entries with a full bucket, the failures are forgotten
+// once the max penalty went by without any
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < pruneEvery {
+		return
+	}
+	l.pruned = now
+	full := pruneEvery
+	if l.cfg.Rate > 0 {
+		full = time.Duration(float64(l.cfg.Burst) / l.cfg.Rate * float64(time.Second))
+	}
+	for k, e := range l.entries {
+		if now.Sub(e.last) > full && now.Sub(e.until) > l.cfg.maxPenalty {
+			delete(l.entries, k)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// clock is a settable now of a Limiter
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newLimiter(t *testing.T, cfg Config) (*Limiter, *clock) {
+	l, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &clock{t: time.Unix(1700000000, 0)}
+	l.now = c.now
+	l.pruned = c.t
+	return l, c
+}
+
+func TestPenalty(t *testing.T) {
+	l, _ := newLimiter(t, Config{Penalty: "1s", MaxPenalty: "10s"})
+	for _, tc := range []struct {
+		fails int
+		want  time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{40, 10 * time.Second},
+	} {
+		if got := l.penalty(tc.fails); got != tc.want {
+			t.Errorf("penalty(%d) = %s, want %s", tc.fails, got, tc.want)
+		}
+	}
+}
+
+func TestFailDoubles(t *testing.T) {
+	l, c := newLimiter(t, Config{Rate: 1, Burst: 10, Penalty: "1s", MaxPenalty: "1m"})
+	l.Fail("ws", "10.0.0.1", "alice")
+	l.Fail("ws", "10.0.0.1", "alice")
+	if ok, wait := l.Allow("ws", "10.0.0.1", "alice"); ok || wait != 2*time.Second {
+		t.Fatalf("Allow = %v, %s, want false, 2s", ok, wait)
+	}
+	c.t = c.t.Add(2 * time.Second)
+	if ok, _ := l.Allow("ws", "10.0.0.1", "alice"); !ok {
+		t.Fatal("still blocked after the penalty")
+	}
+	l.Success("ws", "10.0.0.1", "alice")
+	l.Fail("ws", "10.0.0.1", "alice")
+	if blocked, wait := l.Blocked("ws", "10.0.0.1", ""); !blocked || wait != time.Second {
+		t.Fatalf("Blocked = %v, %s, want true, 1s after a success", blocked, wait)
+	}
+}
+
+func TestBan(t *testing.T) {
+	l, c := newLimiter(t, Config{Rate: 1, Burst: 10, Penalty: "1s", MaxPenalty: "1s", BanAfter: 3, BanFor: "1h"})
+	for i := 0; i < 3; i++ {
+		l.Fail("publickey", "10.0.0.1", "alice")
+	}
+	c.t = c.t.Add(time.Minute)
+	if ok, wait := l.Allow("publickey", "10.0.0.1", "bob"); ok || wait != time.Hour-time.Minute {
+		t.Fatalf("banned ip: Allow = %v, %s", ok, wait)
+	}
+	// the user is not locked out from elsewhere
+	if ok, _ := l.Allow("publickey", "10.0.0.2", "alice"); !ok {
+		t.Fatal("user banned from another ip")
+	}
+	// nor is the ip on another endpoint
+	if ok, _ := l.Allow("ws", "10.0.0.1", "alice"); !ok {
+		t.Fatal("ip banned on another endpoint")
+	}
+	// a success does not lift a ban
+	l.Success("publickey", "10.0.0.1", "alice")
+	if blocked, _ := l.Blocked("publickey", "10.0.0.1", ""); !blocked {
+		t.Fatal("ban lifted by a success")
+	}
+	c.t = c.t.Add(time.Hour)
+	if ok, _ := l.Allow("publickey", "10.0.0.1", "alice"); !ok {
+		t.Fatal("still banned after BanFor")
+	}
+}
+
+func TestUserRate(t *testing.T) {
+	l, _ := newLimiter(t, Config{Rate: 1, Burst: 2})
+	for i, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if ok, _ := l.Allow("ws", ip, "alice"); !ok {
+			t.Fatalf("attempt %d refused", i+1)
+		}
+	}
+	if ok, _ := l.Allow("ws", "10.0.0.3", "alice"); ok {
+		t.Fatal("user over its rate allowed from a new ip")
+	}
+	if ok, _ := l.Allow("ws", "10.0.0.3", "bob"); !ok {
+		t.Fatal("other user refused")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	l, c := newLimiter(t, Config{Rate: 1, Burst: 10, Penalty: "1s", MaxPenalty: "1m"})
+	l.Allow("ws", "10.0.0.1", "alice")
+	l.Fail("ws", "10.0.0.2", "")
+	if n := len(l.entries); n != 4 {
+		t.Fatalf("%d entries, want 4", n)
+	}
+	// too early, nothing is dropped
+	c.t = c.t.Add(30 * time.Second)
+	l.Allow("ws", "10.0.0.3", "")
+	if n := len(l.entries); n != 5 {
+		t.Fatalf("%d entries, want 5", n)
+	}
+	// the buckets are full and the penalties over max penalty ago
+	c.t = c.t.Add(2 * time.Minute)
+	l.Allow("ws", "10.0.0.4", "")
+	if n := len(l.entries); n != 1 {
+		t.Fatalf("%d entries after prune, want 1", n)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	l, _ := newLimiter(t, Config{Rate: 1, Burst: 1, Penalty: "1h", BanAfter: 1, BanFor: "1h", Allow: []string{"10.0.0.0/8", "::1/128"}})
+	for _, tc := range []struct {
+		ip      string
+		trusted bool
+	}{
+		{"10.1.2.3", true},
+		{"::1", true},
+		{"192.168.0.1", false},
+		{"not an ip", false},
+	} {
+		if got := l.Trusted(tc.ip); got != tc.trusted {
+			t.Errorf("Trusted(%q) = %v", tc.ip, got)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		l.Fail("ws", "10.1.2.3", "alice")
+		if ok, _ := l.Allow("ws", "10.1.2.3", "alice"); !ok {
+			t.Fatal("trusted ip limited")
+		}
+	}
+	if len(l.entries) != 0 {
+		t.Fatal("trusted ip recorded")
+	}
+	if _, err := New(Config{Allow: []string{"10.0.0.1"}}); err == nil {
+		t.Fatal("invalid cidr accepted")
+	}
+}
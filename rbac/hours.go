@@ -0,0 +1,99 @@
+package rbac
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// window is a daily time range on some weekdays, it may cross midnight
+type window struct {
+	days     [7]bool
+	from, to int
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseDays(s string) (days [7]bool, err error) {
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		from, ok := weekdays[bounds[0]]
+		if !ok {
+			return days, fmt.Errorf("invalid weekday: %s", bounds[0])
+		}
+		to := from
+		if len(bounds) == 2 {
+			to, ok = weekdays[bounds[1]]
+			if !ok {
+				return days, fmt.Errorf("invalid weekday: %s", bounds[1])
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return
+}
+
+// parseWindow parses "[days ]HH:MM-HH:MM", e.g. "Mon-Fri 09:00-18:00"
+func parseWindow(s string) (w window, err error) {
+	fields := strings.Fields(s)
+	clock := ""
+	switch len(fields) {
+	case 1:
+		for d := range w.days {
+			w.days[d] = true
+		}
+		clock = fields[0]
+	case 2:
+		w.days, err = parseDays(fields[0])
+		if err != nil {
+			return
+		}
+		clock = fields[1]
+	default:
+		return w, fmt.Errorf("invalid hours: %s", s)
+	}
+	bounds := strings.SplitN(clock, "-", 2)
+	if len(bounds) != 2 {
+		return w, fmt.Errorf("invalid hours: %s", s)
+	}
+	w.from, err = parseClock(bounds[0])
+	if err != nil {
+		return
+	}
+	w.to, err = parseClock(bounds[1])
+	return
+}
+
+// contains reports if t is in the window, the days are the start days
+// of ranges crossing midnight
+func (w window) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return w.days[t.Weekday()] && m >= w.from && m < w.to
+	}
+	if m >= w.from {
+		return w.days[t.Weekday()]
+	}
+	return m < w.to && w.days[(t.Weekday()+6)%7]
+}
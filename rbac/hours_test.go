@@ -0,0 +1,97 @@
+package rbac
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	for _, tc := range []struct {
+		s   string
+		err bool
+	}{
+		{"09:00-18:00", false},
+		{"Mon-Fri 09:00-18:00", false},
+		{"sat,sun 10:00-12:00", false},
+		{"Fri-Mon 22:00-06:00", false},
+		{"Mon-Fri", true},
+		{"09:00", true},
+		{"Mon-Fri 9h-18h", true},
+		{"Mon-Funday 09:00-18:00", true},
+		{"Mon Tue 09:00-18:00", true},
+		{"25:00-26:00", true},
+	} {
+		_, err := parseWindow(tc.s)
+		if (err != nil) != tc.err {
+			t.Errorf("parseWindow(%q) error = %v", tc.s, err)
+		}
+	}
+}
+
+func TestParseDays(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want []time.Weekday
+	}{
+		{"mon", []time.Weekday{time.Monday}},
+		{"Mon-Wed", []time.Weekday{time.Monday, time.Tuesday, time.Wednesday}},
+		{"fri-mon", []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday}},
+		{"sun,tue", []time.Weekday{time.Sunday, time.Tuesday}},
+	} {
+		days, err := parseDays(tc.s)
+		if err != nil {
+			t.Fatalf("parseDays(%q): %v", tc.s, err)
+		}
+		var want [7]bool
+		for _, d := range tc.want {
+			want[d] = true
+		}
+		if days != want {
+			t.Errorf("parseDays(%q) = %v, want %v", tc.s, days, want)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(day int, clock string) time.Time {
+		c, err := time.Parse("15:04", clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2024, 1, day, c.Hour(), c.Minute(), 0, 0, time.UTC)
+	}
+	for _, tc := range []struct {
+		window string
+		t      time.Time
+		in     bool
+	}{
+		{"09:00-18:00", at(1, "09:00"), true},
+		{"09:00-18:00", at(1, "17:59"), true},
+		{"09:00-18:00", at(1, "18:00"), false},
+		{"09:00-18:00", at(7, "12:00"), true},
+		{"Mon-Fri 09:00-18:00", at(5, "12:00"), true},
+		{"Mon-Fri 09:00-18:00", at(6, "12:00"), false},
+		{"Mon-Fri 09:00-18:00", at(1, "08:59"), false},
+		// crossing midnight, the day is the one it starts on
+		{"22:00-06:00", at(1, "23:00"), true},
+		{"22:00-06:00", at(1, "05:59"), true},
+		{"22:00-06:00", at(1, "06:00"), false},
+		{"Fri 22:00-06:00", at(5, "23:30"), true},
+		{"Fri 22:00-06:00", at(6, "03:00"), true},
+		{"Fri 22:00-06:00", at(4, "23:30"), false},
+		{"Fri 22:00-06:00", at(5, "03:00"), false},
+		{"Sat 22:00-06:00", at(6, "23:00"), true},
+		{"Sat 22:00-06:00", at(7, "01:00"), true},
+		{"Sat 22:00-06:00", at(8, "01:00"), false},
+		{"Sun 22:00-06:00", at(8, "01:00"), true},
+	} {
+		w, err := parseWindow(tc.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.contains(tc.t); got != tc.in {
+			t.Errorf("%q contains %s = %v, want %v", tc.window, tc.t.Format("Mon 15:04"), got, tc.in)
+		}
+	}
+}
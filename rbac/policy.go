@@ -0,0 +1,340 @@
+package rbac
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// effects of a rule
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// modes of a request
+const (
+	ModeTTY  = "tty"
+	ModeSFTP = "sftp"
+)
+
+// NamespaceLabel is the container label holding the kubernetes namespace
+const NamespaceLabel = "io.kubernetes.pod.namespace"
+
+// Rule matches requests, every non-empty field must match. Names are
+// path.Match patterns, e.g. "web-*", an empty list matches everything
+type Rule struct {
+	Name   string `json:"name"`
+	Effect string `json:"effect"`
+
+	Users      []string `json:"users"`
+	Groups     []string `json:"groups"`
+	Nodes      []string `json:"nodes"`
+	Pods       []string `json:"pods"`
+	Namespaces []string `json:"namespaces"`
+	Containers []string `json:"containers"`
+	// Labels of the container and its image, values are patterns too
+	Labels map[string]string `json:"labels"`
+
+	// Roles are the exec users, the first one is the default
+	Roles    []string `json:"roles"`
+	Commands []string `json:"commands"`
+	// Modes are tty and sftp, empty allows both
+	Modes    []string `json:"modes"`
+	ReadOnly bool     `json:"read_only"`
+	// Hours are time windows like "Mon-Fri 09:00-18:00" or "22:00-06:00"
+	Hours    []string `json:"hours"`
+	Timezone string   `json:"timezone"`
+
+	hours []window
+	loc   *time.Location
+}
+
+// Policy is an ordered list of rules, the first matching one decides
+type Policy struct {
+	// Default is the effect when no rule matches, deny if empty
+	Default string `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+// Request is an exec asked by a user
+type Request struct {
+	User      string
+	Groups    []string
+	Node      string
+	Pod       string
+	Container string
+	// Labels are nil when unknown, e.g. on the relay: rules needing
+	// labels then may allow but never deny, the backend has the final say
+	Labels map[string]string
+	Role   string
+	Cmd    string
+	Mode   string
+	Time   time.Time
+}
+
+// Decision .
+type Decision struct {
+	Allowed  bool
+	Rule     string
+	Reason   string
+	Role     string
+	ReadOnly bool
+}
+
+// Load reads a json policy
+func Load(file string) (*Policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse .
+func Parse(data []byte) (*Policy, error) {
+	p := &Policy{}
+	err := json.Unmarshal(data, p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Default == "" {
+		p.Default = Deny
+	}
+	if p.Default != Allow && p.Default != Deny {
+		return nil, fmt.Errorf("invalid default effect: %s", p.Default)
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if r.Effect != Allow && r.Effect != Deny {
+			return nil, fmt.Errorf("rule %s: invalid effect: %s", r.Name, r.Effect)
+		}
+		r.loc = time.Local
+		if r.Timezone != "" {
+			r.loc, err = time.LoadLocation(r.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %s", r.Name, err)
+			}
+		}
+		for _, h := range r.Hours {
+			w, err := parseWindow(h)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %s", r.Name, err)
+			}
+			r.hours = append(r.hours, w)
+		}
+	}
+	return p, nil
+}
+
+// match reports if s matches one of the patterns, or the patterns are empty
+func match(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if p == "*" {
+			// path.Match stops at "/", e.g. in commands
+			return true
+		}
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, ss []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, s := range ss {
+		if match(patterns, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchLabels reports if the labels match, and whether it was known
+func (r *Rule) matchLabels(labels map[string]string) (ok bool, known bool) {
+	if len(r.Labels) == 0 && len(r.Namespaces) == 0 {
+		return true, true
+	}
+	if labels == nil {
+		return false, false
+	}
+	if !match(r.Namespaces, labels[NamespaceLabel]) {
+		return false, true
+	}
+	for k, p := range r.Labels {
+		v, exists := labels[k]
+		if !exists {
+			return false, true
+		}
+		if ok, _ := path.Match(p, v); !ok {
+			return false, true
+		}
+	}
+	return true, true
+}
+
+// matchTarget reports if the rule applies to the user and the container
+func (r *Rule) matchTarget(req Request) bool {
+	if len(r.Users) > 0 || len(r.Groups) > 0 {
+		// a user matches either by name or by group
+		byUser := len(r.Users) > 0 && match(r.Users, req.User)
+		byGroup := len(r.Groups) > 0 && matchAny(r.Groups, req.Groups)
+		if !byUser && !byGroup {
+			return false
+		}
+	}
+	if !match(r.Nodes, req.Node) || !match(r.Pods, req.Pod) || !match(r.Containers, req.Container) {
+		return false
+	}
+	if len(r.Modes) > 0 && !match(r.Modes, req.Mode) {
+		return false
+	}
+	if len(r.hours) > 0 {
+		now := req.Time.In(r.loc)
+		in := false
+		for _, w := range r.hours {
+			if w.contains(now) {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return false
+		}
+	}
+	return true
+}
+
+// role returns the exec user granted for the requested one, "" if denied
+func (r *Rule) role(requested string) string {
+	if len(r.Roles) == 0 {
+		if requested == "" {
+			return "root"
+		}
+		return requested
+	}
+	if requested == "" {
+		if r.Roles[0] == "*" {
+			return "root"
+		}
+		return r.Roles[0]
+	}
+	if match(r.Roles, requested) {
+		return requested
+	}
+	return ""
+}
+
+// Decide evaluates the rules in order, a nil policy allows everything
+func (p *Policy) Decide(req Request) Decision {
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+	if req.Mode == "" {
+		req.Mode = ModeTTY
+	}
+	if p == nil {
+		d := Decision{Allowed: true, Role: req.Role}
+		if d.Role == "" {
+			d.Role = "root"
+		}
+		return d
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if !r.matchTarget(req) {
+			continue
+		}
+		labelsOk, known := r.matchLabels(req.Labels)
+		if r.Effect == Deny {
+			if !labelsOk {
+				continue
+			}
+			if !match(r.Commands, req.Cmd) {
+				continue
+			}
+			if len(r.Roles) > 0 && !match(r.Roles, roleOrRoot(req.Role)) {
+				continue
+			}
+			return Decision{Rule: r.Name, Reason: "denied by rule " + r.Name}
+		}
+		if !labelsOk && known {
+			continue
+		}
+		if !match(r.Commands, req.Cmd) {
+			continue
+		}
+		role := r.role(req.Role)
+		if role == "" {
+			continue
+		}
+		return Decision{
+			Allowed:  true,
+			Rule:     r.Name,
+			Role:     role,
+			ReadOnly: r.ReadOnly && req.Mode == ModeTTY,
+		}
+	}
+	if p.Default == Allow {
+		return Decision{Allowed: true, Rule: "default", Role: roleOrRoot(req.Role)}
+	}
+	return Decision{Rule: "default", Reason: fmt.Sprintf("no rule allows %s to run %s as %s on %s",
+		req.User, req.Cmd, roleOrRoot(req.Role), req.target())}
+}
+
+func roleOrRoot(role string) string {
+	if role == "" {
+		return "root"
+	}
+	return role
+}
+
+// target formats the container as pod/container@node
+func (req Request) target() string {
+	name := req.Container
+	if req.Pod != "" {
+		name = req.Pod + "/" + name
+	}
+	return name + "@" + req.Node
+}
+
+// String .
+func (d Decision) String() string {
+	if !d.Allowed {
+		return "deny: " + d.Reason
+	}
+	s := "allow by rule " + d.Rule + " as " + d.Role
+	if d.ReadOnly {
+		s += ", read-only"
+	}
+	return s
+}
+
+// ParseLabels parses k=v,k2=v2
+func ParseLabels(s string) map[string]string {
+	labels := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		} else {
+			labels[parts[0]] = ""
+		}
+	}
+	return labels
+}
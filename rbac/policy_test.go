@@ -0,0 +1,110 @@
+package rbac
+
+import (
+	"testing"
+	"time"
+)
+
+const testPolicy = `{
+	"rules": [
+		{"name": "no-prod-db", "effect": "deny", "containers": ["db-*"], "labels": {"env": "prod"}},
+		{"name": "no-rm", "effect": "deny", "commands": ["rm*"]},
+		{"name": "ops", "effect": "allow", "groups": ["ops"], "roles": ["*"]},
+		{"name": "dev-sftp", "effect": "allow", "users": ["dev-*"], "modes": ["sftp"], "roles": ["app"]},
+		{"name": "dev", "effect": "allow", "users": ["dev-*"], "nodes": ["node-1"], "roles": ["app", "www"], "read_only": true},
+		{"name": "oncall", "effect": "allow", "users": ["alice"], "hours": ["Mon-Fri 09:00-18:00"], "timezone": "UTC"},
+		{"name": "team-ns", "effect": "allow", "users": ["bob"], "namespaces": ["team-*"]}
+	]
+}`
+
+func TestDecide(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a Monday
+	work := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	night := time.Date(2024, 1, 1, 22, 0, 0, 0, time.UTC)
+	prod := map[string]string{"env": "prod"}
+	for _, tc := range []struct {
+		name     string
+		req      Request
+		allowed  bool
+		rule     string
+		role     string
+		readOnly bool
+	}{
+		{"ops any role", Request{User: "carol", Groups: []string{"ops"}, Container: "web", Role: "postgres"}, true, "ops", "postgres", false},
+		{"ops default root", Request{User: "carol", Groups: []string{"ops"}, Container: "web"}, true, "ops", "root", false},
+		{"deny by labels", Request{User: "carol", Groups: []string{"ops"}, Container: "db-1", Labels: prod}, false, "no-prod-db", "", false},
+		{"deny needs labels", Request{User: "carol", Groups: []string{"ops"}, Container: "db-1", Labels: map[string]string{"env": "dev"}}, true, "ops", "root", false},
+		// unknown labels on the relay never deny, the backend decides
+		{"labels unknown", Request{User: "carol", Groups: []string{"ops"}, Container: "db-1"}, true, "ops", "root", false},
+		{"deny command", Request{User: "carol", Groups: []string{"ops"}, Container: "web", Cmd: "rm -rf tmp"}, false, "no-rm", "", false},
+		{"dev first role", Request{User: "dev-x", Node: "node-1", Container: "web"}, true, "dev", "app", true},
+		{"dev other role", Request{User: "dev-x", Node: "node-1", Container: "web", Role: "www"}, true, "dev", "www", true},
+		{"dev role refused", Request{User: "dev-x", Node: "node-1", Container: "web", Role: "root"}, false, "default", "", false},
+		{"dev other node", Request{User: "dev-x", Node: "node-2", Container: "web"}, false, "default", "", false},
+		{"dev sftp writable", Request{User: "dev-x", Node: "node-2", Container: "web", Mode: ModeSFTP}, true, "dev-sftp", "app", false},
+		{"hours in", Request{User: "alice", Container: "web", Time: work}, true, "oncall", "root", false},
+		{"hours out", Request{User: "alice", Container: "web", Time: night}, false, "default", "", false},
+		{"namespace", Request{User: "bob", Container: "web", Labels: map[string]string{NamespaceLabel: "team-a"}}, true, "team-ns", "root", false},
+		{"other namespace", Request{User: "bob", Container: "web", Labels: map[string]string{NamespaceLabel: "kube-system"}}, false, "default", "", false},
+		{"nobody", Request{User: "mallory", Container: "web"}, false, "default", "", false},
+	} {
+		d := p.Decide(tc.req)
+		if d.Allowed != tc.allowed || d.Rule != tc.rule || d.Role != tc.role || d.ReadOnly != tc.readOnly {
+			t.Errorf("%s: got %+v", tc.name, d)
+		}
+	}
+}
+
+func TestDecideNil(t *testing.T) {
+	var p *Policy
+	if d := p.Decide(Request{User: "anyone"}); !d.Allowed || d.Role != "root" {
+		t.Fatalf("nil policy: %+v", d)
+	}
+	if d := p.Decide(Request{User: "anyone", Role: "app"}); !d.Allowed || d.Role != "app" {
+		t.Fatalf("nil policy: %+v", d)
+	}
+}
+
+func TestDefaultAllow(t *testing.T) {
+	p, err := Parse([]byte(`{"default": "allow", "rules": [{"effect": "deny", "users": ["mallory"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := p.Decide(Request{User: "alice"}); !d.Allowed || d.Rule != "default" {
+		t.Errorf("alice: %+v", d)
+	}
+	if d := p.Decide(Request{User: "mallory"}); d.Allowed || d.Rule != "#1" {
+		t.Errorf("mallory: %+v", d)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, policy := range []string{
+		`{"default": "maybe"}`,
+		`{"rules": [{"effect": "permit"}]}`,
+		`{"rules": [{"effect": "allow", "hours": ["9-18"]}]}`,
+		`{"rules": [{"effect": "allow", "timezone": "Nowhere/Else"}]}`,
+		`not json`,
+	} {
+		if _, err := Parse([]byte(policy)); err == nil {
+			t.Errorf("%s: no error", policy)
+		}
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	got := ParseLabels("env=prod,,team=a=b,flag")
+	want := map[string]string{"env": "prod", "team": "a=b", "flag": ""}
+	if len(got) != len(want) {
+		t.Fatalf("got %v", got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
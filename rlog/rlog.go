@@ -0,0 +1,55 @@
+package rlog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Logger is the process logger, Setup configures it
+var Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+// Payload enables logging the terminal content, which may hold secrets
+var Payload bool
+
+var level = new(slog.LevelVar)
+
+// Setup sets the level (debug, info, warn or error) and the format
+// (text or json), the standard log calls go through it too
+func Setup(lvl, format string, payload bool) error {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(lvl))
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	var w io.Writer = os.Stderr
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "", "text":
+		Logger = slog.New(slog.NewTextHandler(w, opts))
+	case "json":
+		Logger = slog.New(slog.NewJSONHandler(w, opts))
+	default:
+		return errors.New("unknown log format: " + format)
+	}
+	Payload = payload
+	slog.SetDefault(Logger)
+	return nil
+}
+
+// With .
+func With(args ...interface{}) *slog.Logger {
+	return Logger.With(args...)
+}
+
+// NewID returns n random bytes as hex
+func NewID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,94 @@
+package rlog
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Span is a timed operation of a trace, in the OpenTelemetry model: spans
+// share the trace ID of their root and point to their parent span. Spans
+// are logged when they end, there is no exporter
+type Span struct {
+	Name     string
+	TraceID  string
+	SpanID   string
+	ParentID string
+	start    time.Time
+	attrs    []interface{}
+	log      *slog.Logger
+}
+
+type spanKey struct{}
+
+// SpanFrom returns the span of ctx, nil if none
+func SpanFrom(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start starts a span, child of the one in ctx or the root of a new trace
+func Start(ctx context.Context, log *slog.Logger, name string, attrs ...interface{}) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	parent := SpanFrom(ctx)
+	if log == nil && parent != nil {
+		log = parent.log
+	}
+	if log == nil {
+		log = Logger
+	}
+	s := &Span{
+		Name:    name,
+		TraceID: NewID(16),
+		SpanID:  NewID(8),
+		start:   time.Now(),
+		attrs:   attrs,
+		log:     log,
+	}
+	if parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// End logs the span, as a warning if err is not nil
+func (s *Span) End(err error) {
+	args := append([]interface{}{
+		"span", s.Name,
+		"trace_id", s.TraceID,
+		"span_id", s.SpanID,
+		"parent_id", s.ParentID,
+		"duration", time.Since(s.start),
+	}, s.attrs...)
+	if err != nil {
+		s.log.Warn("span", append(args, "error", err.Error())...)
+		return
+	}
+	s.log.Info("span", args...)
+}
+
+// Traceparent formats the span as a W3C traceparent header
+func (s *Span) Traceparent() string {
+	return "00-" + s.TraceID + "-" + s.SpanID + "-01"
+}
+
+// Remote returns ctx with the span of a traceparent header as parent,
+// ctx as is if the header is not valid
+func Remote(ctx context.Context, traceparent string) context.Context {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, &Span{
+		Name:    "remote",
+		TraceID: parts[1],
+		SpanID:  parts[2],
+	})
+}
@@ -0,0 +1,283 @@
+package session
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wukezhan/rainbow/rlog"
+)
+
+// LockFile keeps the locks across restarts, the relays and frontends
+// given the same file share them. They are in memory only if empty
+var LockFile = ""
+
+// locks are the users refused new sessions
+var locks = struct {
+	sync.Mutex
+	users map[string]time.Time
+	// mod is the mtime of LockFile when last read or written
+	mod time.Time
+}{users: map[string]time.Time{}}
+
+// loadLocks reads LockFile again if another process changed it, the
+// current locks are kept if it can not be read
+func loadLocks() {
+	if LockFile == "" {
+		return
+	}
+	fi, err := os.Stat(LockFile)
+	if err != nil || fi.ModTime().Equal(locks.mod) {
+		return
+	}
+	data, err := ioutil.ReadFile(LockFile)
+	if err != nil {
+		return
+	}
+	users := map[string]time.Time{}
+	if err := json.Unmarshal(data, &users); err != nil {
+		rlog.Logger.Warn("lock file", "file", LockFile, "error", err)
+		return
+	}
+	locks.users, locks.mod = users, fi.ModTime()
+}
+
+func saveLocks() error {
+	if LockFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(locks.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(LockFile+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(LockFile+".tmp", LockFile)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(LockFile); err == nil {
+		locks.mod = fi.ModTime()
+	}
+	return nil
+}
+
+// Locked reports if the user is locked out of new sessions
+func Locked(user string) bool {
+	locks.Lock()
+	defer locks.Unlock()
+	loadLocks()
+	_, ok := locks.users[user]
+	return ok
+}
+
+// Lock locks the user out of new sessions, the running ones are kept
+func Lock(user string) error {
+	locks.Lock()
+	defer locks.Unlock()
+	loadLocks()
+	locks.users[user] = time.Now()
+	return saveLocks()
+}
+
+// Unlock .
+func Unlock(user string) error {
+	locks.Lock()
+	defer locks.Unlock()
+	loadLocks()
+	delete(locks.users, user)
+	return saveLocks()
+}
+
+// Info describes a live session for the admin api
+type Info struct {
+	ID       string    `json:"id"`
+	User     string    `json:"user"`
+	Kind     string    `json:"kind"`
+	Mode     string    `json:"mode"`
+	Targets  []string  `json:"targets"`
+	Start    time.Time `json:"start"`
+	Idle     string    `json:"idle"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	RemoteIP string    `json:"remote_ip"`
+}
+
+// Info .
+func (sess *Instance) Info() Info {
+	return Info{
+		ID:       sess.ID,
+		User:     sess.User.Name,
+		Kind:     sess.Kind,
+		Mode:     modeNames[sess.Mode],
+		Targets:  sess.openTargets(),
+		Start:    sess.Start,
+		Idle:     sess.idle().Round(time.Second).String(),
+		BytesIn:  atomic.LoadInt64(&sess.bytesIn),
+		BytesOut: atomic.LoadInt64(&sess.bytesOut),
+		RemoteIP: sess.RemoteIP,
+	}
+}
+
+// Sessions lists the live sessions, oldest first
+func Sessions() []Info {
+	infos := []Info{}
+	for _, sess := range live() {
+		infos = append(infos, sess.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Start.Before(infos[j].Start)
+	})
+	return infos
+}
+
+// find returns the live sessions by id, or of a user
+func find(id, user string) []*Instance {
+	found := []*Instance{}
+	for _, sess := range live() {
+		if (id != "" && sess.ID == id) || (id == "" && user != "" && sess.User.Name == user) {
+			found = append(found, sess)
+		}
+	}
+	return found
+}
+
+// AdminHandler serves the admin api under /admin/, every request must
+// carry the token as "Authorization: Bearer <token>":
+//
+//	GET  /admin/sessions                    live sessions
+//	POST /admin/kill       id= or user=     terminate sessions
+//	POST /admin/message    msg= [id=|user=] write a banner into sessions, all if none given
+//	POST /admin/lock       user= [kill=1]   refuse new sessions of the user
+//	POST /admin/unlock     user=
+//	GET  /admin/locks                       locked users
+//	GET  /admin/nodes                       registered backends
+//	POST /admin/drain      node= [undo=1]   route no new session to the node
+func AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, Sessions())
+	})
+	mux.HandleFunc("/admin/kill", func(w http.ResponseWriter, r *http.Request) {
+		id, user := r.FormValue("id"), r.FormValue("user")
+		if id == "" && user == "" {
+			http.Error(w, "id or user required", http.StatusBadRequest)
+			return
+		}
+		found := find(id, user)
+		for _, sess := range found {
+			sess.Log.Info("session killed by admin", "remote", r.RemoteAddr)
+			sess.Expire("session terminated by an administrator")
+		}
+		writeJSON(w, map[string]int{"killed": len(found)})
+	})
+	mux.HandleFunc("/admin/message", func(w http.ResponseWriter, r *http.Request) {
+		msg := strings.TrimSpace(r.FormValue("msg"))
+		if msg == "" {
+			http.Error(w, "msg required", http.StatusBadRequest)
+			return
+		}
+		found := live()
+		if r.FormValue("id") != "" || r.FormValue("user") != "" {
+			found = find(r.FormValue("id"), r.FormValue("user"))
+		}
+		for _, sess := range found {
+			sess.Notify(msg)
+		}
+		writeJSON(w, map[string]int{"sent": len(found)})
+	})
+	mux.HandleFunc("/admin/lock", func(w http.ResponseWriter, r *http.Request) {
+		user := r.FormValue("user")
+		if user == "" {
+			http.Error(w, "user required", http.StatusBadRequest)
+			return
+		}
+		if err := Lock(user); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		killed := 0
+		if r.FormValue("kill") == "1" {
+			for _, sess := range find("", user) {
+				sess.Expire("your account has been locked by an administrator")
+				killed++
+			}
+		}
+		writeJSON(w, map[string]int{"killed": killed})
+	})
+	mux.HandleFunc("/admin/unlock", func(w http.ResponseWriter, r *http.Request) {
+		user := r.FormValue("user")
+		if user == "" {
+			http.Error(w, "user required", http.StatusBadRequest)
+			return
+		}
+		if err := Unlock(user); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]string{"unlocked": user})
+	})
+	mux.HandleFunc("/admin/locks", func(w http.ResponseWriter, r *http.Request) {
+		locks.Lock()
+		defer locks.Unlock()
+		loadLocks()
+		writeJSON(w, locks.users)
+	})
+	mux.HandleFunc("/admin/nodes", func(w http.ResponseWriter, r *http.Request) {
+		if Nodes == nil {
+			http.Error(w, "no node registry", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, Nodes.List())
+	})
+	mux.HandleFunc("/admin/drain", func(w http.ResponseWriter, r *http.Request) {
+		node := r.FormValue("node")
+		if node == "" {
+			http.Error(w, "node required", http.StatusBadRequest)
+			return
+		}
+		if Nodes == nil {
+			http.Error(w, "no node registry", http.StatusNotFound)
+			return
+		}
+		drain := r.FormValue("undo") != "1"
+		Nodes.Drain(node, drain)
+		writeJSON(w, map[string]bool{"drained": drain})
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path != "/admin/sessions" && r.URL.Path != "/admin/locks" && r.URL.Path != "/admin/nodes" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,488 @@
+package session
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/wukezhan/rainbow/term"
+	"github.com/wukezhan/readline"
+	"github.com/wukezhan/ssh"
+
+	color "github.com/logrusorgru/aurora"
+)
+
+// BroadcastEscape is the control key of a broadcast, Ctrl-]
+const BroadcastEscape = 0x1d
+
+// castFlush is how long a partial line waits before it is labelled and shown
+const castFlush = 300 * time.Millisecond
+
+// castMax is the max of targets, one digit toggles each
+const castMax = 9
+
+var castColors = []func(interface{}) color.Value{
+	color.Green, color.Blue, color.Magenta, color.Cyan, color.Brown, color.Red,
+}
+
+// castTarget is one container of a broadcast
+type castTarget struct {
+	ID      int
+	Label   string
+	bio     BIO
+	enabled bool
+	closed  bool
+	ready   bool
+	pending []byte
+	last    time.Time
+}
+
+// Broadcast is a BIO fanning the input out to several containers,
+// their output is merged into a labelled, interleaved stream
+type Broadcast struct {
+	Sess    *Instance
+	targets []*castTarget
+	// out is never closed, ended is once every target is, done on Close
+	out     chan []byte
+	ended   chan struct{}
+	done    chan struct{}
+	win     ssh.Window
+	escaped bool
+	lock    sync.Mutex
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+// NewBroadcast dials every target, the ones failing are reported and skipped
+func NewBroadcast(sess *Instance, ts []target) (*Broadcast, error) {
+	if len(ts) > castMax {
+		return nil, fmt.Errorf("at most %d targets", castMax)
+	}
+	b := &Broadcast{
+		Sess:  sess,
+		out:   make(chan []byte, 64),
+		ended: make(chan struct{}),
+		done:  make(chan struct{}),
+		win:   sess.win,
+	}
+	for i, t := range ts {
+		bio := sess.newDocker(url.Values{
+			"host": []string{t.uc.NodeName},
+			"pod":  []string{t.uc.PodName},
+			"name": []string{t.container},
+			"cmd":  []string{"bash"},
+		})
+		label := castColors[i%len(castColors)]("[" + strconv.Itoa(i+1) + " " + t.String() + "] ").Bold().String()
+		err := bio.Dial()
+		if err != nil {
+			sess.writeLines(label + "login error: " + err.Error())
+			continue
+		}
+		b.targets = append(b.targets, &castTarget{
+			ID:      i + 1,
+			Label:   label,
+			bio:     bio,
+			enabled: true,
+		})
+	}
+	if len(b.targets) == 0 {
+		return nil, errors.New("no target connected")
+	}
+	for _, ct := range b.targets {
+		b.wg.Add(1)
+		go b.pump(ct)
+	}
+	go func() {
+		b.wg.Wait()
+		close(b.ended)
+	}()
+	go b.flusher()
+	return b, nil
+}
+
+// pump reads the output of one target into the merged stream
+func (b *Broadcast) pump(ct *castTarget) {
+	defer b.wg.Done()
+	for {
+		_, p, err := ct.bio.Read()
+		if err != nil {
+			b.lock.Lock()
+			ct.closed = true
+			q := b.flushLocked(ct, true)
+			b.lock.Unlock()
+			b.emit(q)
+			b.notice(ct.Label + "closed")
+			return
+		}
+		b.lock.Lock()
+		if !ct.ready {
+			// 必须在 exec attached 之后才能 resize，否则可能触发 no such exec 错误
+			ct.ready = true
+			ct.bio.ResizeTTY(b.win)
+		}
+		b.lock.Unlock()
+		if len(p) == 0 || p[0] != term.Output {
+			continue
+		}
+		b.lock.Lock()
+		ct.pending = append(ct.pending, p[1:]...)
+		ct.last = time.Now()
+		q := b.flushLocked(ct, false)
+		b.lock.Unlock()
+		b.emit(q)
+	}
+}
+
+// emit passes q to Read, it is dropped once the broadcast is closed. It
+// must not be called under the lock, a stalled reader would hold it
+func (b *Broadcast) emit(q []byte) {
+	if len(q) == 0 {
+		return
+	}
+	select {
+	case b.out <- q:
+	case <-b.done:
+	}
+}
+
+// flushLocked takes the complete lines of ct, and the partial one if force,
+// to emit them
+func (b *Broadcast) flushLocked(ct *castTarget, force bool) []byte {
+	var buf bytes.Buffer
+	for {
+		i := bytes.IndexByte(ct.pending, '\n')
+		if i < 0 {
+			break
+		}
+		buf.WriteString(ct.Label)
+		buf.Write(ct.pending[:i+1])
+		ct.pending = ct.pending[i+1:]
+	}
+	if force && len(ct.pending) > 0 {
+		buf.WriteString(ct.Label)
+		buf.Write(ct.pending)
+		buf.WriteString("\r\n")
+		ct.pending = nil
+	}
+	return buf.Bytes()
+}
+
+// flusher shows partial lines, e.g. prompts, once they are idle
+func (b *Broadcast) flusher() {
+	ticker := time.NewTicker(castFlush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.ended:
+			return
+		case <-b.done:
+			return
+		}
+		var qs [][]byte
+		b.lock.Lock()
+		for _, ct := range b.targets {
+			if len(ct.pending) > 0 && time.Since(ct.last) > castFlush {
+				qs = append(qs, b.flushLocked(ct, true))
+			}
+		}
+		b.lock.Unlock()
+		for _, q := range qs {
+			b.emit(q)
+		}
+	}
+}
+
+// notice writes a message of the broadcast itself into the stream
+func (b *Broadcast) notice(msg string) {
+	b.emit([]byte("\r\n" + color.Bold("[broadcast] ").String() + msg + "\r\n"))
+}
+
+// status lists the targets and whether they receive the input
+func (b *Broadcast) status() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	lines := []string{}
+	for _, ct := range b.targets {
+		state := color.Green("on").String()
+		if ct.closed {
+			state = color.Red("closed").String()
+		} else if !ct.enabled {
+			state = color.BrightBlack("off").String()
+		}
+		lines = append(lines, ct.Label+state)
+	}
+	return strings.Join(lines, "\r\n") +
+		"\r\nCtrl-] then 1-9 toggles a target, a enables all, l lists, Ctrl-] again sends it"
+}
+
+// control handles the key following the escape
+func (b *Broadcast) control(c byte) {
+	switch {
+	case c == 'a':
+		b.lock.Lock()
+		for _, ct := range b.targets {
+			ct.enabled = true
+		}
+		b.lock.Unlock()
+		b.notice(b.status())
+	case c == 'l':
+		b.notice(b.status())
+	case c >= '1' && c <= '9':
+		b.lock.Lock()
+		for _, ct := range b.targets {
+			if ct.ID == int(c-'0') {
+				ct.enabled = !ct.enabled
+			}
+		}
+		b.lock.Unlock()
+		b.notice(b.status())
+	}
+}
+
+// Init .
+func (b *Broadcast) Init(conf map[string]string) {}
+
+// Ping .
+func (b *Broadcast) Ping() (err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, ct := range b.targets {
+		if !ct.closed {
+			ct.bio.Ping()
+		}
+	}
+	return nil
+}
+
+// Write fans the input out to the enabled targets
+func (b *Broadcast) Write(data []byte) (int, error) {
+	start := 0
+	for i, c := range data {
+		if !b.escaped {
+			if c == BroadcastEscape {
+				b.send(data[start:i])
+				b.escaped = true
+			}
+			continue
+		}
+		b.escaped = false
+		start = i + 1
+		if c == BroadcastEscape {
+			b.send([]byte{BroadcastEscape})
+		} else {
+			b.control(c)
+		}
+	}
+	if !b.escaped {
+		b.send(data[start:])
+	}
+	return len(data), nil
+}
+
+func (b *Broadcast) send(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, ct := range b.targets {
+		if ct.enabled && !ct.closed {
+			ct.bio.Write(data)
+		}
+	}
+}
+
+// WriteWebtty .
+func (b *Broadcast) WriteWebtty(data []byte) (int, error) {
+	if len(data) > 0 && data[0] == term.Input {
+		return b.Write(data[1:])
+	}
+	return 0, nil
+}
+
+// Read returns the merged output as webtty messages, what is left of it
+// once every target is closed
+func (b *Broadcast) Read() (int, []byte, error) {
+	var q []byte
+	select {
+	case q = <-b.out:
+	case <-b.done:
+		return 0, nil, io.EOF
+	case <-b.ended:
+		select {
+		case q = <-b.out:
+		default:
+			return 0, nil, io.EOF
+		}
+	}
+	return websocket.BinaryMessage, append([]byte{term.Output}, q...), nil
+}
+
+// ResizeTTY resizes every attached target
+func (b *Broadcast) ResizeTTY(win ssh.Window) (err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.win = win
+	for _, ct := range b.targets {
+		if ct.ready && !ct.closed {
+			ct.bio.ResizeTTY(win)
+		}
+	}
+	return nil
+}
+
+// WritePipe .
+func (b *Broadcast) WritePipe() (err error) {
+	return errors.New("broadcast is only available in the relay shell")
+}
+
+// Dial .
+func (b *Broadcast) Dial() (err error) { return nil }
+
+// Close closes every target
+func (b *Broadcast) Close() (err error) {
+	b.once.Do(func() {
+		close(b.done)
+		b.lock.Lock()
+		for _, ct := range b.targets {
+			ct.bio.Close()
+		}
+		b.lock.Unlock()
+	})
+	if b.Sess.BIO == BIO(b) {
+		b.Sess.BIO = nil
+	}
+	return nil
+}
+
+// Running .
+func (b *Broadcast) Running() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, ct := range b.targets {
+		if !ct.closed {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTTY .
+func (b *Broadcast) IsTTY() bool {
+	return true
+}
+
+// Kind .
+func (b *Broadcast) Kind() string {
+	return "broadcast"
+}
+
+// parseSelection parses "1,3-5" or "all" into indexes of a list of n
+func parseSelection(s string, n int) ([]int, error) {
+	s = strings.TrimSpace(s)
+	if s == "all" || s == "*" {
+		idx := make([]int, n)
+		for i := range idx {
+			idx[i] = i
+		}
+		return idx, nil
+	}
+	idx := []int{}
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		from, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		to := from
+		if len(bounds) == 2 {
+			to, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if from < 1 || to > n || from > to {
+			return nil, fmt.Errorf("out of range: %s", part)
+		}
+		for i := from; i <= to; i++ {
+			idx = append(idx, i-1)
+		}
+	}
+	return idx, nil
+}
+
+// broadcastItem completes `broadcast` like `goto`
+func (sess *Instance) broadcastItem() readline.PrefixCompleterInterface {
+	return readline.PcItem("broadcast", sess.targetItems()...)
+}
+
+// StartBroadcast handles `broadcast [name...]`, every container matching
+// a name is selected, without names the user picks from the list
+func (sess *Instance) StartBroadcast(line string) {
+	args := strings.Fields(line)[1:]
+	if len(sess.containers) == 0 {
+		sess.refreshContainers()
+	}
+	ts := []target{}
+	if len(args) > 0 {
+		for _, name := range args {
+			ts = append(ts, sess.resolve(name)...)
+		}
+	} else {
+		all := sess.targets()
+		for i, t := range all {
+			sess.ri.Write([]byte(fmt.Sprintf("\r%s) %s\n",
+				color.Green(i+1).Bold().String(),
+				color.Red(t.String()).String(),
+			)))
+		}
+		sess.ri.SetPrompt("targets (e.g. 1,3-5 or all): ")
+		sel, err := sess.ri.Readline()
+		sess.SetPrompt()
+		if err != nil {
+			return
+		}
+		idx, err := parseSelection(sel, len(all))
+		if err != nil {
+			sess.writeLines("invalid selection: " + err.Error())
+			return
+		}
+		for _, i := range idx {
+			ts = append(ts, all[i])
+		}
+	}
+	// a container selected twice would get every key twice
+	seen := map[string]bool{}
+	uniq := []target{}
+	for _, t := range ts {
+		if !seen[t.String()] {
+			seen[t.String()] = true
+			uniq = append(uniq, t)
+		}
+	}
+	ts = uniq
+	if len(ts) == 0 {
+		sess.writeLines("no target selected")
+		return
+	}
+	if len(ts) > castMax {
+		sess.writeLines(fmt.Sprintf("%d targets selected, at most %d", len(ts), castMax))
+		return
+	}
+
+	b, err := NewBroadcast(sess, ts)
+	if err != nil {
+		sess.writeLines("broadcast error: " + err.Error())
+		return
+	}
+	sess.writeLines(b.status())
+	sess.attach(sess.newWindow(fmt.Sprintf("broadcast (%d)", len(b.targets)), b))
+}
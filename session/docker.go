@@ -3,17 +3,35 @@ package session
 import (
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/wukezhan/rainbow/metrics"
+	"github.com/wukezhan/rainbow/mtls"
+	"github.com/wukezhan/rainbow/rlog"
 	"github.com/wukezhan/rainbow/term"
 	"github.com/wukezhan/ssh"
 )
 
+// BackendTLS are the client certificates of the relay, the backends are
+// dialed with wss and must present a certificate of their node name. The
+// backends are dialed with ws if nil
+var BackendTLS *mtls.Certs
+
+// BackendToken is sent as the AuthToken of the init message to the backends
+var BackendToken string
+
+// BackendCompression offers permessage-deflate to the backends, it costs
+// more cpu than it saves on a fast network
+var BackendCompression bool
+
 // Docker .
 type Docker struct {
 	Sess          *Instance
@@ -24,15 +42,18 @@ type Docker struct {
 	NodeName      string
 	NodeHost      string
 	NodePort      string
+	Engine        string
 	Cmd           string
 	sftp          bool
+	binary        bool
+	readOnly      bool
+	guard         *guard
 	WsConn        *websocket.Conn
 	lock          sync.Mutex
 }
 
 // Init .
 func (dc *Docker) Init(conf map[string]string) {
-	log.Println("init", conf)
 	dc.ContainerName = conf["ContainerName"]
 	dc.UserName = conf["UserName"]
 	dc.RoleName = conf["RoleName"]
@@ -50,6 +71,7 @@ func (dc *Docker) Init(conf map[string]string) {
 	} else {
 		dc.PodName = ""
 	}
+	dc.Engine = conf["Engine"]
 	if conf["NodeName"] != "" {
 		dc.NodeName = conf["NodeName"]
 	} else {
@@ -101,12 +123,52 @@ func (dc *Docker) Ping() (err error) {
 
 // Write .
 func (dc *Docker) Write(data []byte) (int, error) {
+	if dc.readOnly {
+		return len(data), nil
+	}
+	if dc.guard != nil {
+		data = dc.guard.filter(data)
+		if len(data) == 0 {
+			return 0, nil
+		}
+	}
+	metrics.Bytes.WithLabelValues(metrics.In).Add(float64(len(data)))
+	atomic.AddInt64(&dc.Sess.bytesIn, int64(len(data)))
 	return 0, dc._write(term.Input, data)
 }
 
 // Read .
 func (dc *Docker) Read() (mt int, p []byte, err error) {
-	return dc.WsConn.ReadMessage()
+	for {
+		mt, p, err = dc.WsConn.ReadMessage()
+		if err != nil {
+			return
+		}
+		// the relay answers the pings and runs its own handshake with the
+		// user, those of the backend are dropped
+		if dc.sftp || len(p) == 0 || !handshake(p[0]) {
+			break
+		}
+	}
+	n := 0
+	if dc.sftp {
+		n = len(p)
+	} else if len(p) > 0 && p[0] == term.Output {
+		if !dc.binary {
+			// the output of older backends is base64
+			p, err = term.RawOutput(p)
+			if err != nil {
+				return
+			}
+		}
+		n = len(p) - 1
+	}
+	metrics.Bytes.WithLabelValues(metrics.Out).Add(float64(n))
+	atomic.AddInt64(&dc.Sess.bytesOut, int64(n))
+	if dc.guard != nil {
+		dc.guard.output(p)
+	}
+	return
 }
 
 // Close .
@@ -117,7 +179,10 @@ func (dc *Docker) Close() (err error) {
 		err = dc.WsConn.Close()
 		dc.WsConn = nil
 	}
-	dc.Sess.BIO = nil
+	// other windows may be active
+	if dc.Sess.BIO == BIO(dc) {
+		dc.Sess.BIO = nil
+	}
 	return nil
 }
 
@@ -129,15 +194,17 @@ func (dc *Docker) WritePipe() (err error) {
 	for {
 		n, err := uio.Read(buf)
 		if err != nil {
-			log.Println("exited", err)
+			dc.Sess.Log.Debug("user read end", "error", err)
 			return err
 		}
 
 		// read from ssh, we need parse the raw payload
 		//log.Println("writing to bio", dc.Sess.Mode, SFTP)
 		if dc.Sess.Mode != SFTP {
-			err = dc._write(term.Input, buf[:n])
+			_, err = dc.Write(buf[:n])
 		} else if uioKind == "ws" || dc.sftp {
+			metrics.Bytes.WithLabelValues(metrics.In).Add(float64(n))
+			atomic.AddInt64(&dc.Sess.bytesIn, int64(n))
 			_, err = dc.WriteWebtty(buf[:n])
 			//log.Println("writing to bio", n, (buf[:n]), err)
 		}
@@ -155,18 +222,145 @@ func (dc *Docker) sendEOL() (err error) {
 
 // Dial .
 func (dc *Docker) Dial() (err error) {
-	query := "pod=" + dc.PodName + "&name=" + dc.ContainerName + "&user=" + dc.UserName + "&role=" + dc.RoleName + "&cmd=" + dc.Cmd
+	_, span := rlog.Start(dc.Sess.Ctx, nil, "backend.dial", "target", dc.target())
+	defer func() {
+		span.End(err)
+	}()
+	d, err := dc.Sess.authorize(dc)
+	if err != nil {
+		return
+	}
+	dc.RoleName = d.Role
+	dc.readOnly = d.ReadOnly
+	if Nodes != nil {
+		host, port, rerr := Nodes.Route(dc.NodeName)
+		if rerr != nil {
+			return fmt.Errorf("%s %s", dc.NodeName, rerr)
+		}
+		if host != "" {
+			dc.NodeHost, dc.NodePort = host, port
+		}
+	}
+	if Guards != nil && !dc.sftp {
+		dc.guard = newGuard(dc)
+	}
+	q := url.Values{
+		"pod":  {dc.PodName},
+		"name": {dc.ContainerName},
+		"user": {dc.UserName},
+		"role": {dc.RoleName},
+		"cmd":  {dc.Cmd},
+		"node": {dc.NodeName},
+		"sid":  {dc.Sess.ID},
+	}
+	if dc.Engine != "" {
+		q.Set("engine", dc.Engine)
+	}
+	if win := dc.Sess.win; win.Width > 0 && win.Height > 0 {
+		q.Set("cols", strconv.Itoa(win.Width))
+		q.Set("rows", strconv.Itoa(win.Height))
+	}
+	if Policy != nil {
+		q.Set("groups", strings.Join(dc.Sess.groups(), ","))
+	}
+	if ttl := dc.ttl(); ttl > 0 {
+		q.Set("ttl", strconv.Itoa(int(ttl.Seconds())+1))
+	}
+	query := q.Encode()
 	u := url.URL{Scheme: "ws", Host: dc.NodeHost + ":" + dc.NodePort, Path: "/term", RawQuery: query}
+	// older backends only speak webtty, with base64 output
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{term.WebttyBinary, term.Webtty}
+	dialer.EnableCompression = BackendCompression
+	if BackendTLS != nil {
+		u.Scheme = "wss"
+		dialer.TLSClientConfig = BackendTLS.Client(dc.NodeName)
+	}
 	var r *http.Response
-	dc.WsConn, r, err = websocket.DefaultDialer.Dial(u.String(), nil)
-	log.Println("proxy to", u.String(), err)
+	header := http.Header{}
+	header.Set("traceparent", span.Traceparent())
+	if ts := tunnel(dc.NodeName); ts != nil {
+		// the backend dialed out to us, it may not be reachable otherwise
+		td := dialer
+		td.NetDial = tunnelDial(ts)
+		dc.WsConn, r, err = td.Dial(u.String(), header)
+		if err != nil {
+			dc.Sess.Log.Warn("tunnel dial error, dialing directly", "target", dc.target(), "error", err)
+		}
+	}
+	if dc.WsConn == nil {
+		dc.WsConn, r, err = dialer.Dial(u.String(), header)
+	}
 	if err != nil {
-		log.Println("connect to backend error!", r)
+		status := ""
+		if r != nil {
+			status = r.Status
+		}
+		dc.Sess.Log.Warn("connect to backend error", "target", dc.target(), "host", dc.NodeHost, "status", status, "error", err)
+		metrics.DialErrors.WithLabelValues(dc.NodeName).Inc()
+		return
 	}
-
+	dc.binary = dc.WsConn.Subprotocol() == term.WebttyBinary
+	dc.WsConn.SetCompressionLevel(term.Compression)
+	init, _ := json.Marshal(term.InitMessage{Arguments: query, AuthToken: BackendToken})
+	err = dc.WsConn.WriteMessage(websocket.TextMessage, init)
 	return
 }
 
+// handshake reports if t is a backend message the user gets from the relay
+func handshake(t byte) bool {
+	switch t {
+	case term.Pong, term.SetWindowTitle, term.SetPreferences, term.SetReconnect:
+		return true
+	}
+	return false
+}
+
+// target formats the container as pod/container@node
+func (dc *Docker) target() string {
+	name := dc.ContainerName + "@" + dc.NodeName
+	if dc.PodName != "" {
+		name = dc.PodName + "/" + name
+	}
+	return name
+}
+
+// ttl is what is left of the max session duration, 0 if unlimited
+func (dc *Docker) ttl() time.Duration {
+	if Timeouts == nil {
+		return 0
+	}
+	l := Timeouts.limits(dc.Sess.User, []string{dc.target()})
+	if l.max == 0 {
+		return 0
+	}
+	return l.max - time.Since(dc.Sess.Start)
+}
+
+// NodeHealth checks the backend of node, reached at host, is up
+func NodeHealth(node, host, port string) error {
+	if port == "" {
+		port = "2356"
+	}
+	client := http.Client{
+		Timeout: 2 * time.Second,
+	}
+	scheme := "http"
+	if BackendTLS != nil {
+		scheme = "https"
+		client.Transport = &http.Transport{TLSClientConfig: BackendTLS.Client(node)}
+	}
+	resp, err := client.Get(scheme + "://" + host + ":" + port + "/health")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
 // Running .
 func (dc *Docker) Running() bool {
 	return dc.WsConn != nil
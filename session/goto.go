@@ -0,0 +1,175 @@
+package session
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/wukezhan/rainbow/api"
+	"github.com/wukezhan/readline"
+
+	color "github.com/logrusorgru/aurora"
+)
+
+// target is a container of the cached list
+type target struct {
+	uc        api.UserContainer
+	container string
+}
+
+// String formats the target as pod/container@node
+func (t target) String() string {
+	name := t.container
+	if t.uc.PodName != "" {
+		name = t.uc.PodName + "/" + name
+	}
+	return name + "@" + t.uc.NodeName
+}
+
+// refreshContainers reloads the containers of the user into the cache
+func (sess *Instance) refreshContainers() (err error) {
+	var ucs []api.UserContainer
+	err, ucs = sess.api().GetContainers(sess.User.Name)
+	if err == nil {
+		sess.containers = ucs
+	}
+	return
+}
+
+// member reports if t is a container of the user, the cache is reloaded
+// if it does not hold t
+func (sess *Instance) member(t target) bool {
+	name := t.String()
+	for i := 0; i < 2; i++ {
+		for _, c := range sess.targets() {
+			if c.String() == name {
+				return true
+			}
+		}
+		if i == 0 && sess.refreshContainers() != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// targets lists every container of the cache
+func (sess *Instance) targets() []target {
+	return containerTargets(sess.containers)
+}
+
+// containerTargets lists every container of ucs
+func containerTargets(ucs []api.UserContainer) []target {
+	ts := []target{}
+	for _, uc := range ucs {
+		for _, c := range uc.Containers {
+			ts = append(ts, target{uc: uc, container: c})
+		}
+	}
+	return ts
+}
+
+// targetItems completes the cached containers as pod/container@node
+func (sess *Instance) targetItems() []readline.PrefixCompleterInterface {
+	return []readline.PrefixCompleterInterface{
+		readline.PcItemDynamic(func(line string) []string {
+			ts := sess.targets()
+			names := make([]string, 0, len(ts))
+			for _, t := range ts {
+				names = append(names, t.String())
+			}
+			return names
+		}),
+	}
+}
+
+// gotoItem completes `goto` with the cached containers
+func (sess *Instance) gotoItem() readline.PrefixCompleterInterface {
+	return readline.PcItem("goto", sess.targetItems()...)
+}
+
+// parseTarget splits pod/container@node, every part but container is optional
+func parseTarget(s string) (pod, container, node string) {
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		s, node = s[:i], s[i+1:]
+	}
+	if i := strings.Index(s, "/"); i >= 0 {
+		pod, s = s[:i], s[i+1:]
+	}
+	container = s
+	return
+}
+
+// resolve finds the targets matching name, exact matches win over partial ones
+func (sess *Instance) resolve(name string) []target {
+	pod, container, node := parseTarget(name)
+	exact := []target{}
+	partial := []target{}
+	for _, t := range sess.targets() {
+		if node != "" && !strings.HasPrefix(t.uc.NodeName, node) {
+			continue
+		}
+		if pod != "" && !strings.HasPrefix(t.uc.PodName, pod) {
+			continue
+		}
+		if t.container == container {
+			exact = append(exact, t)
+		} else if strings.Contains(t.container, container) {
+			partial = append(partial, t)
+		}
+	}
+	if len(exact) > 0 {
+		return exact
+	}
+	return partial
+}
+
+// choose asks the user to pick one of ts
+func (sess *Instance) choose(ts []target) (t target, ok bool) {
+	for i, t := range ts {
+		sess.ri.Write([]byte(fmt.Sprintf("\r%s) %s\n",
+			color.Green(i+1).Bold().String(),
+			color.Red(t.String()).String(),
+		)))
+	}
+	sess.ri.SetPrompt(fmt.Sprintf("select [1-%d]: ", len(ts)))
+	defer sess.SetPrompt()
+	line, err := sess.ri.Readline()
+	if err != nil {
+		return
+	}
+	idx, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || idx < 1 || idx > len(ts) {
+		sess.ri.Write([]byte("\rinvalid id\r\n"))
+		return
+	}
+	return ts[idx-1], true
+}
+
+// Goto handles `goto pod/container@node`
+func (sess *Instance) Goto(line string) {
+	args := strings.Fields(line)
+	if len(args) != 2 {
+		sess.writeLines("goto <pod/container@node>")
+		return
+	}
+	if len(sess.containers) == 0 {
+		sess.refreshContainers()
+	}
+	ts := sess.resolve(args[1])
+	switch len(ts) {
+	case 0:
+		sess.writeLines("no such container: " + args[1])
+		return
+	case 1:
+	default:
+		sess.writeLines(color.Brown("ambiguous name " + args[1] + ":").String())
+		t, ok := sess.choose(ts)
+		if !ok {
+			return
+		}
+		ts = []target{t}
+	}
+	sess.writeLines("goto " + ts[0].String())
+	sess.open(ts[0].uc, ts[0].container)
+}
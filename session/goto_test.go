@@ -0,0 +1,37 @@
+package session
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/wukezhan/rainbow/api"
+)
+
+func TestResolve(t *testing.T) {
+	sess := &Instance{containers: []api.UserContainer{
+		{NodeName: "node-1", Containers: []string{"web", "web-2", "db"}},
+		{NodeName: "node-2", PodName: "shop", Containers: []string{"web", "cache"}},
+	}}
+	for _, tc := range []struct {
+		name string
+		want []string
+	}{
+		{"web", []string{"web@node-1", "shop/web@node-2"}},
+		{"web@node-1", []string{"web@node-1"}},
+		// a node or pod prefix does not make the name partial
+		{"web@node", []string{"web@node-1", "shop/web@node-2"}},
+		{"web@node-2", []string{"shop/web@node-2"}},
+		{"sh/web", []string{"shop/web@node-2"}},
+		{"we@node-1", []string{"web@node-1", "web-2@node-1"}},
+		{"cache", []string{"shop/cache@node-2"}},
+		{"db@node-2", []string{}},
+	} {
+		got := []string{}
+		for _, t := range sess.resolve(tc.name) {
+			got = append(got, t.String())
+		}
+		if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+			t.Errorf("resolve(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/wukezhan/rainbow/term"
+
+	color "github.com/logrusorgru/aurora"
+)
+
+// Guards are the dangerous command rules, nil disables the input inspection
+var Guards *GuardPolicy
+
+// GuardRule applies to the targets matching one of its patterns
+type GuardRule struct {
+	// Targets are pod/container@node glob patterns, "*" matches all
+	Targets []string `json:"targets"`
+	// Deny and Confirm are regular expressions of command lines
+	Deny    []string `json:"deny"`
+	Confirm []string `json:"confirm"`
+
+	deny    []*regexp.Regexp
+	confirm []*regexp.Regexp
+}
+
+// GuardPolicy .
+type GuardPolicy struct {
+	Rules []GuardRule `json:"rules"`
+}
+
+// LoadGuards .
+func LoadGuards(file string) (*GuardPolicy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	gp := &GuardPolicy{}
+	err = json.Unmarshal(data, gp)
+	if err != nil {
+		return nil, err
+	}
+	for i := range gp.Rules {
+		r := &gp.Rules[i]
+		for _, expr := range r.Deny {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			r.deny = append(r.deny, re)
+		}
+		for _, expr := range r.Confirm {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			r.confirm = append(r.confirm, re)
+		}
+	}
+	return gp, nil
+}
+
+func (r *GuardRule) applies(target string) bool {
+	for _, p := range r.Targets {
+		if p == "*" {
+			return true
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// verdicts of a command line
+const (
+	guardAllow = iota
+	guardConfirm
+	guardDeny
+)
+
+// check returns the verdict of line on target, deny wins over confirm
+func (gp *GuardPolicy) check(target, line string) int {
+	verdict := guardAllow
+	for i := range gp.Rules {
+		r := &gp.Rules[i]
+		if !r.applies(target) {
+			continue
+		}
+		for _, re := range r.deny {
+			if re.MatchString(line) {
+				return guardDeny
+			}
+		}
+		for _, re := range r.confirm {
+			if re.MatchString(line) {
+				verdict = guardConfirm
+			}
+		}
+	}
+	return verdict
+}
+
+// alternate screen switches, full-screen apps are not inspected
+var (
+	_altOn  = [][]byte{[]byte("\x1b[?1049h"), []byte("\x1b[?1047h"), []byte("\x1b[?47h")}
+	_altOff = [][]byte{[]byte("\x1b[?1049l"), []byte("\x1b[?1047l"), []byte("\x1b[?47l")}
+)
+
+func lastIndexAny(p []byte, seps [][]byte) int {
+	last := -1
+	for _, sep := range seps {
+		if i := bytes.LastIndex(p, sep); i > last {
+			last = i
+		}
+	}
+	return last
+}
+
+// guard rebuilds the command line typed into a container, it is best
+// effort: once the cursor moves or the shell completes or recalls a line,
+// the line is unknown. Such a dirty line is still checked by what was
+// typed, e.g. `rm -rf /va<TAB>`, and confirmed if that matches a rule
+type guard struct {
+	dc     *Docker
+	target string
+	line   []rune
+	dirty  bool
+	esc    int
+	seq    []rune
+	alt    bool
+	// confirming holds the line waiting for the answer
+	confirming string
+	answer     []rune
+	lock       sync.Mutex
+}
+
+func newGuard(dc *Docker) *guard {
+	return &guard{
+		dc:     dc,
+		target: dc.target(),
+	}
+}
+
+// output tracks the alternate screen from the backend output
+func (g *guard) output(p []byte) {
+	if len(p) == 0 || p[0] != term.Output {
+		return
+	}
+	q := p[1:]
+	on, off := lastIndexAny(q, _altOn), lastIndexAny(q, _altOff)
+	if on < 0 && off < 0 {
+		return
+	}
+	g.lock.Lock()
+	g.alt = on > off
+	g.line, g.dirty = nil, false
+	g.lock.Unlock()
+}
+
+func (g *guard) notice(msg string) {
+	g.dc.Sess.UIO.Write([]byte("\r\n" + color.Brown("[guard] ").Bold().String() + msg))
+}
+
+func (g *guard) reset() {
+	g.line = g.line[:0]
+	g.dirty = false
+	g.esc = 0
+}
+
+// filter returns the input to forward to the container
+func (g *guard) filter(data []byte) []byte {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.alt && g.confirming == "" {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	for _, r := range string(data) {
+		if g.confirming != "" {
+			out = append(out, g.answerRune(r)...)
+			continue
+		}
+		if g.esc > 0 {
+			// ESC [ params final, ESC O x or ESC x
+			g.seq = append(g.seq, r)
+			if g.esc == 1 && (r == '[' || r == 'O') {
+				g.esc = 2
+			} else if g.esc == 1 || (r >= 0x40 && r <= 0x7e) {
+				g.esc = 0
+				if s := string(g.seq); s != "[200~" && s != "[201~" {
+					// anything but a bracketed paste may edit the line
+					g.dirty = true
+				}
+			}
+			out = append(out, string(r)...)
+			continue
+		}
+		switch {
+		case r == '\r' || r == '\n':
+			line := strings.TrimSpace(string(g.line))
+			dirty := g.dirty
+			g.reset()
+			if line == "" {
+				break
+			}
+			verdict := Guards.check(g.target, line)
+			if dirty && verdict != guardAllow {
+				// the shell may have completed it into anything, the
+				// user is asked rather than refused
+				g.confirming = line
+				g.answer = nil
+				g.notice(fmt.Sprintf("the line was edited, it starts like `%s`, run it on %s? type yes to confirm: ",
+					line, color.Red(g.target).Bold().String()))
+				continue
+			}
+			switch verdict {
+			case guardDeny:
+				g.dc.Sess.Log.Warn("guard blocked", "user", g.dc.Sess.User.Name, "target", g.target, "line", line)
+				g.notice(color.Red("blocked ").String() + "`" + line + "` on " + g.target + "\r\n")
+				// drop the line instead of running it
+				out = append(out, 0x03)
+				continue
+			case guardConfirm:
+				g.confirming = line
+				g.answer = nil
+				g.notice(fmt.Sprintf("run `%s` on %s? type yes to confirm: ",
+					line, color.Red(g.target).Bold().String()))
+				continue
+			}
+		case r == 0x7f || r == 0x08:
+			if len(g.line) > 0 {
+				g.line = g.line[:len(g.line)-1]
+			}
+		case r == 0x03 || r == 0x15:
+			// Ctrl-C, Ctrl-U
+			g.reset()
+		case r == 0x17:
+			// Ctrl-W
+			s := strings.TrimRight(string(g.line), " ")
+			g.line = []rune(s[:strings.LastIndex(s, " ")+1])
+		case r == 0x1b:
+			g.esc = 1
+			g.seq = g.seq[:0]
+		case r < 0x20:
+			// completion, history search, cursor moves...
+			g.dirty = true
+		default:
+			g.line = append(g.line, r)
+		}
+		out = append(out, string(r)...)
+	}
+	return out
+}
+
+// answerRune handles the answer of a confirmation, it is echoed by the
+// relay as the container does not see it
+func (g *guard) answerRune(r rune) []byte {
+	switch {
+	case r == '\r' || r == '\n':
+		line := g.confirming
+		ok := strings.TrimSpace(string(g.answer)) == "yes"
+		g.confirming, g.answer = "", nil
+		g.dc.Sess.UIO.Write([]byte("\r\n"))
+		if ok {
+			g.dc.Sess.Log.Info("guard confirmed", "user", g.dc.Sess.User.Name, "target", g.target, "line", line)
+			return []byte{'\r'}
+		}
+		g.dc.Sess.Log.Info("guard cancelled", "user", g.dc.Sess.User.Name, "target", g.target, "line", line)
+		g.notice("cancelled\r\n")
+		return []byte{0x03}
+	case r == 0x03:
+		g.answer = nil
+		return g.answerRune('\r')
+	case r == 0x7f || r == 0x08:
+		if len(g.answer) > 0 {
+			g.answer = g.answer[:len(g.answer)-1]
+			g.dc.Sess.UIO.Write([]byte("\b \b"))
+		}
+	case r >= 0x20:
+		g.answer = append(g.answer, r)
+		g.dc.Sess.UIO.Write([]byte(string(r)))
+	}
+	return nil
+}
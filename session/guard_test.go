@@ -0,0 +1,103 @@
+package session
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wukezhan/rainbow/term"
+)
+
+// testUIO keeps what the relay shows the user
+type testUIO struct {
+	UIO
+	out bytes.Buffer
+}
+
+func (u *testUIO) Write(b []byte) (int, error) {
+	return u.out.Write(b)
+}
+
+const testGuards = `{
+	"rules": [
+		{"targets": ["*"], "deny": ["^rm\\s+-rf\\s+/"], "confirm": ["^reboot"]},
+		{"targets": ["db-*"], "deny": ["^psql"]}
+	]
+}`
+
+func loadTestGuards(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "guards.json")
+	if err := os.WriteFile(file, []byte(testGuards), 0600); err != nil {
+		t.Fatal(err)
+	}
+	gp, err := LoadGuards(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := Guards
+	Guards = gp
+	t.Cleanup(func() { Guards = old })
+}
+
+func TestGuardFilter(t *testing.T) {
+	loadTestGuards(t)
+	// input steps are sent to filter, output ones, "<" prefixed, come
+	// from the container
+	for _, tc := range []struct {
+		name      string
+		container string
+		steps     []string
+		want      string
+		notice    string
+	}{
+		{"allow", "web", []string{"ls -l\r"}, "ls -l\r", ""},
+		{"deny", "web", []string{"rm -rf /\r"}, "rm -rf /\x03", "blocked"},
+		{"deny split", "web", []string{"rm -r", "f /", "\r"}, "rm -rf /\x03", "blocked"},
+		{"other target", "web", []string{"psql\r"}, "psql\r", ""},
+		{"target rule", "db-1", []string{"psql\r"}, "psql\x03", "blocked"},
+		{"backspace", "web", []string{"rm -rf /x\x7f\x7f\x7f\x7f\x7f\x7f\x7f\x7fls\r"}, "rm -rf /x\x7f\x7f\x7f\x7f\x7f\x7f\x7f\x7fls\r", ""},
+		{"ctrl-u", "web", []string{"rm -rf /\x15ls\r"}, "rm -rf /\x15ls\r", ""},
+		{"ctrl-c", "web", []string{"rm -rf /\x03\r"}, "rm -rf /\x03\r", ""},
+		{"confirm yes", "web", []string{"reboot\r", "yes\r"}, "reboot\r", "type yes"},
+		{"confirm no", "web", []string{"reboot\r", "no\r"}, "reboot\x03", "cancelled"},
+		{"confirm ctrl-c", "web", []string{"reboot\r", "ye\x03"}, "reboot\x03", "cancelled"},
+		{"confirm then run", "web", []string{"reboot\r", "yes\r", "ls\r"}, "reboot\rls\r", "type yes"},
+		// the shell completed the line, what was typed is still checked
+		{"dirty tab", "web", []string{"rm -rf /va\t\r"}, "rm -rf /va\t", "was edited"},
+		{"dirty tab yes", "web", []string{"rm -rf /va\t\r", "yes\r"}, "rm -rf /va\t\r", "was edited"},
+		{"dirty allowed", "web", []string{"ls /va\t\r"}, "ls /va\t\r", ""},
+		{"dirty arrow", "web", []string{"\x1b[Dreboot\r"}, "\x1b[Dreboot", "was edited"},
+		// a bracketed paste is checked like a typed line
+		{"paste", "web", []string{"\x1b[200~rm -rf /\x1b[201~\r"}, "\x1b[200~rm -rf /\x1b[201~\x03", "blocked"},
+		{"paste split", "web", []string{"\x1b[20", "0~rm -rf /\x1b", "[201~\r"}, "\x1b[200~rm -rf /\x1b[201~\x03", "blocked"},
+		// vim is not inspected while on the alternate screen
+		{"alt screen", "web", []string{"<\x1b[?1049h", "rm -rf /\r"}, "rm -rf /\r", ""},
+		{"alt screen off", "web", []string{"<\x1b[?1049h", ":q\r", "<\x1b[?1049l", "rm -rf /\r"}, ":q\rrm -rf /\x03", "blocked"},
+		{"alt screen toggled", "web", []string{"<\x1b[?1049hx\x1b[?1049l", "rm -rf /\r"}, "rm -rf /\x03", "blocked"},
+	} {
+		uio := &testUIO{}
+		sess := &Instance{UIO: uio, Log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+		g := newGuard(&Docker{Sess: sess, ContainerName: tc.container, NodeName: "node-1"})
+		var got []byte
+		for _, step := range tc.steps {
+			if strings.HasPrefix(step, "<") {
+				g.output(append([]byte{term.Output}, step[1:]...))
+				continue
+			}
+			got = append(got, g.filter([]byte(step))...)
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: forwarded %q, want %q", tc.name, got, tc.want)
+		}
+		if tc.notice != "" && !strings.Contains(uio.out.String(), tc.notice) {
+			t.Errorf("%s: notice %q, want %q", tc.name, uio.out.String(), tc.notice)
+		}
+		if tc.notice == "" && uio.out.Len() > 0 {
+			t.Errorf("%s: unexpected notice %q", tc.name, uio.out.String())
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package session
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wukezhan/rainbow/api"
+	"github.com/wukezhan/rainbow/pkey"
+	"github.com/wukezhan/readline"
+	"github.com/wukezhan/ssh"
+
+	color "github.com/logrusorgru/aurora"
+)
+
+// keysItem .
+func (sess *Instance) keysItem() readline.PrefixCompleterInterface {
+	return readline.PcItem("keys",
+		readline.PcItem("list"),
+		readline.PcItem("add"),
+		readline.PcItem("remove",
+			readline.PcItemDynamic(func(line string) []string {
+				err, uks := sess.api().GetKeys(sess.User.Name)
+				if err != nil {
+					return nil
+				}
+				fps := make([]string, 0, len(uks))
+				for _, uk := range uks {
+					fps = append(fps, uk.FingerPrint)
+				}
+				return fps
+			}),
+		),
+		readline.PcItem("generate",
+			readline.PcItem(pkey.Ed25519),
+			readline.PcItem(pkey.ECDSA),
+			readline.PcItem(pkey.RSA),
+		),
+	)
+}
+
+func (sess *Instance) writeLines(s string) {
+	sess.ri.Write([]byte("\r" + strings.Replace(strings.TrimRight(s, "\n"), "\n", "\r\n", -1) + "\r\n"))
+}
+
+// isSessionKey tells if uk is the key used to log into this session
+func (sess *Instance) isSessionKey(uk api.UserKey) bool {
+	if sess.User.Key == nil {
+		return false
+	}
+	allowed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(uk.PubKey))
+	if err == nil && ssh.KeysEqual(sess.User.Key, allowed) {
+		return true
+	}
+	return uk.FingerPrint != "" && pkey.FingerprintMatch(uk.FingerPrint, sess.User.Key)
+}
+
+// Keys handles `keys list|add|remove|generate`
+func (sess *Instance) Keys(line string) {
+	args := strings.Fields(line)
+	if len(args) < 2 {
+		sess.writeLines("keys list|add <pubkey>|remove <fingerprint>|generate [alg]")
+		return
+	}
+	ra := sess.api()
+	switch args[1] {
+	case "list":
+		err, uks := ra.GetKeys(sess.User.Name)
+		if err != nil {
+			sess.writeLines("list keys error: " + err.Error())
+			return
+		}
+		for i, uk := range uks {
+			current := ""
+			if sess.isSessionKey(uk) {
+				current = color.Green(" (current)").String()
+			}
+			sess.writeLines(fmt.Sprintf("%s) %s %s%s",
+				color.Green(i+1).Bold().String(),
+				color.Magenta(uk.Title).Bold(),
+				uk.FingerPrint,
+				current,
+			))
+		}
+	case "add":
+		if len(args) < 4 {
+			sess.writeLines("keys add <type> <base64> [title]")
+			return
+		}
+		pubKey := strings.Join(args[2:], " ")
+		_, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+		if err != nil {
+			sess.writeLines("invalid public key: " + err.Error())
+			return
+		}
+		fp, _ := pkey.FingerprintSHA256([]byte(pubKey))
+		title := comment
+		if title == "" {
+			title = fp
+		}
+		err = ra.AddKey(sess.User.Name, title, pubKey)
+		if err != nil {
+			sess.writeLines("add key error: " + err.Error())
+			return
+		}
+		sess.writeLines("key added: " + fp)
+	case "remove":
+		if len(args) != 3 {
+			sess.writeLines("keys remove <fingerprint>")
+			return
+		}
+		err, uks := ra.GetKeys(sess.User.Name)
+		if err != nil {
+			sess.writeLines("list keys error: " + err.Error())
+			return
+		}
+		var target *api.UserKey
+		for i, uk := range uks {
+			if uk.FingerPrint == args[2] {
+				target = &uks[i]
+				break
+			}
+			pub, _, _, _, e := ssh.ParseAuthorizedKey([]byte(uk.PubKey))
+			if e == nil && pkey.FingerprintMatch(args[2], pub) {
+				target = &uks[i]
+				break
+			}
+		}
+		if target == nil {
+			sess.writeLines("no such key: " + args[2])
+			return
+		}
+		if sess.isSessionKey(*target) {
+			sess.writeLines("refused: " + target.Title + " is the key of the current session")
+			return
+		}
+		err = ra.RemoveKey(sess.User.Name, target.FingerPrint)
+		if err != nil {
+			sess.writeLines("remove key error: " + err.Error())
+			return
+		}
+		sess.writeLines("key removed: " + target.Title)
+	case "generate":
+		alg := pkey.Ed25519
+		if len(args) > 2 {
+			alg = args[2]
+		}
+		signer, err := pkey.GenerateKey(alg, 0)
+		if err != nil {
+			sess.writeLines("generate key error: " + err.Error())
+			return
+		}
+		title := sess.User.Name + "@relay"
+		privateKey, err := pkey.EncodePrivateKeyToOpenSSH(signer, title, nil)
+		if err != nil {
+			sess.writeLines("generate key error: " + err.Error())
+			return
+		}
+		pubKey, err := pkey.MarshalPublicKey(signer.Public())
+		if err != nil {
+			sess.writeLines("generate key error: " + err.Error())
+			return
+		}
+		pubLine := strings.TrimSpace(string(pubKey)) + " " + title
+		err = ra.AddKey(sess.User.Name, title, pubLine)
+		if err != nil {
+			sess.writeLines("add key error: " + err.Error())
+			return
+		}
+		fp, _ := pkey.FingerprintSHA256(pubKey)
+		sess.writeLines(color.Green("key added: " + fp).String())
+		sess.writeLines("save the private key below, it is not stored anywhere:")
+		sess.writeLines(string(privateKey))
+	default:
+		sess.writeLines("keys list|add <pubkey>|remove <fingerprint>|generate [alg]")
+	}
+}
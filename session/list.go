@@ -0,0 +1,158 @@
+package session
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/wukezhan/rainbow/api"
+
+	color "github.com/logrusorgru/aurora"
+)
+
+// open logs into the container of uc, same as the `N.M` syntax. The
+// numbered lists may come from the profile, e.g. the favourites, the
+// container must be one the api lists for the user like with `goto`
+func (sess *Instance) open(uc api.UserContainer, container string) {
+	t := target{uc: uc, container: container}
+	if !sess.member(t) {
+		sess.writeLines("no such container: " + t.String())
+		return
+	}
+	sess.Mode = RelayTTY
+	sess.TTY(url.Values{
+		"host": []string{uc.NodeName},
+		"pod":  []string{uc.PodName},
+		"name": []string{container},
+		"cmd":  []string{"bash"},
+	})
+}
+
+// listPods prints ucs numbered from offset+1
+func (sess *Instance) listPods(ucs []api.UserContainer, offset int) {
+	l := sess.ri
+	for i, uc := range ucs {
+		if len(uc.Containers) == 0 {
+			continue
+		}
+		n := offset + i + 1
+		l.Write([]byte(fmt.Sprintf(
+			"\r%s) %s@%s 🐳\n",
+			color.Green(n).Bold().String(),
+			color.Magenta(uc.PodName).Bold(),
+			color.Blue(uc.NodeName).Bold(),
+		)))
+		for idx := 0; idx < len(uc.Containers); idx++ {
+			name := uc.Containers[idx]
+			l.Write([]byte(fmt.Sprintf(
+				"\r    %s.%s) %s\n",
+				color.Green(n).Bold().String(),
+				color.Green(idx).Bold().String(),
+				color.Red(name).String(),
+			)))
+		}
+	}
+}
+
+// nodesHealth checks the backend of every node concurrently
+func nodesHealth(nodes []api.UserNode) map[string]error {
+	health := map[string]error{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node api.UserNode) {
+			defer wg.Done()
+			var err error
+			registered := false
+			if Nodes != nil {
+				// the heartbeats tell, no need to probe
+				registered, err = Nodes.Status(node.NodeName)
+			}
+			if !registered && tunnel(node.NodeName) != nil {
+				// connected out to us, the tunnel is its liveness
+				registered = true
+			}
+			if !registered {
+				host := node.NodeHost
+				if host == "" {
+					host = node.NodeName
+				}
+				err = NodeHealth(node.NodeName, host, "")
+			}
+			lock.Lock()
+			health[node.NodeName] = err
+			lock.Unlock()
+		}(node)
+	}
+	wg.Wait()
+	return health
+}
+
+func healthLabel(err error) string {
+	switch err {
+	case nil:
+	case ErrNodeDraining:
+		return color.Brown("● draining").String()
+	case ErrNodeFull:
+		return color.Brown("● full").String()
+	default:
+		return color.Red("● down").String()
+	}
+	return color.Green("● up").String()
+}
+
+// listNodes prints the containers grouped per node, with the backend health
+func (sess *Instance) listNodes() {
+	err, ucs := sess.api().GetContainers(sess.User.Name)
+	if err != nil {
+		sess.writeLines("list nodes error: " + err.Error())
+		return
+	}
+	sess.containers = ucs
+	pods := map[string][]api.UserContainer{}
+	for _, uc := range ucs {
+		pods[uc.NodeName] = append(pods[uc.NodeName], uc)
+	}
+	err, nodes := sess.api().GetNodes(sess.User.Name)
+	if err != nil {
+		// fall back to the nodes of the containers
+		nodes = nil
+		for name := range pods {
+			nodes = append(nodes, api.UserNode{NodeName: name})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].NodeName < nodes[j].NodeName
+	})
+	health := nodesHealth(nodes)
+
+	sess.ucs = nil
+	for _, node := range nodes {
+		sess.ri.Write([]byte(fmt.Sprintf("\r%s %s\n",
+			color.Blue(node.NodeName).Bold(),
+			healthLabel(health[node.NodeName]),
+		)))
+		sess.listPods(pods[node.NodeName], len(sess.ucs))
+		sess.ucs = append(sess.ucs, pods[node.NodeName]...)
+	}
+}
+
+// listGroups prints the pods shared with the user's groups
+func (sess *Instance) listGroups() {
+	err, ugs := sess.api().GetGroups(sess.User.Name)
+	if err != nil {
+		sess.writeLines("list groups error: " + err.Error())
+		return
+	}
+	sess.ucs = nil
+	for _, ug := range ugs {
+		sess.ri.Write([]byte(fmt.Sprintf("\r%s (%d)\n",
+			color.Cyan(ug.GroupName).Bold(),
+			len(ug.Pods),
+		)))
+		sess.listPods(ug.Pods, len(sess.ucs))
+		sess.ucs = append(sess.ucs, ug.Pods...)
+	}
+}
@@ -0,0 +1,209 @@
+package session
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Nodes are the backends known by their heartbeats, nil routes every node
+// name to its host on the default port
+var Nodes *NodeRegistry
+
+// states of a registered node
+var (
+	ErrNodeDown     = errors.New("node is down")
+	ErrNodeDraining = errors.New("node is draining")
+	ErrNodeFull     = errors.New("node is full")
+)
+
+// Node is what a backend reports in its heartbeats
+type Node struct {
+	Name string `json:"name"`
+	// Addr is the host:port the relay dials
+	Addr string `json:"addr"`
+	// Engines are the docker engines of the backend and their health
+	Engines map[string]bool `json:"engines"`
+	// Capacity is the max of execs, 0 if unlimited
+	Capacity int `json:"capacity"`
+	Running  int `json:"running"`
+	// Draining is set by a backend shutting down
+	Draining bool `json:"draining"`
+}
+
+// NodeStatus is a registered node as seen by the relay
+type NodeStatus struct {
+	Node
+	Seen   time.Time `json:"seen"`
+	Status string    `json:"status"`
+	// Drained is set by an administrator, new sessions go elsewhere
+	Drained bool `json:"drained"`
+}
+
+// NodeRegistry .
+type NodeRegistry struct {
+	// TTL is how long a node is up after its last heartbeat
+	TTL     time.Duration
+	nodes   map[string]*NodeStatus
+	drained map[string]bool
+	lock    sync.Mutex
+}
+
+// NewNodeRegistry .
+func NewNodeRegistry(ttl time.Duration) *NodeRegistry {
+	return &NodeRegistry{
+		TTL:     ttl,
+		nodes:   map[string]*NodeStatus{},
+		drained: map[string]bool{},
+	}
+}
+
+// Heartbeat registers n or refreshes it
+func (nr *NodeRegistry) Heartbeat(n Node) {
+	nr.lock.Lock()
+	defer nr.lock.Unlock()
+	ns, ok := nr.nodes[n.Name]
+	if !ok {
+		ns = &NodeStatus{}
+		nr.nodes[n.Name] = ns
+	}
+	ns.Node = n
+	ns.Seen = time.Now()
+}
+
+// Drain stops routing new sessions to the node, or routes them again,
+// the running ones are kept
+func (nr *NodeRegistry) Drain(name string, drain bool) {
+	nr.lock.Lock()
+	defer nr.lock.Unlock()
+	if drain {
+		nr.drained[name] = true
+	} else {
+		delete(nr.drained, name)
+	}
+}
+
+// check returns the state of ns, nil if it takes new sessions
+func (nr *NodeRegistry) check(ns *NodeStatus) error {
+	switch {
+	case time.Since(ns.Seen) > nr.TTL:
+		return ErrNodeDown
+	case nr.drained[ns.Name] || ns.Draining:
+		return ErrNodeDraining
+	case ns.Capacity > 0 && ns.Running >= ns.Capacity:
+		return ErrNodeFull
+	}
+	for _, healthy := range ns.Engines {
+		if healthy {
+			return nil
+		}
+	}
+	return ErrNodeDown
+}
+
+// Status returns the state of the node, registered is false if it never
+// sent a heartbeat
+func (nr *NodeRegistry) Status(name string) (registered bool, err error) {
+	nr.lock.Lock()
+	defer nr.lock.Unlock()
+	ns, ok := nr.nodes[name]
+	if !ok {
+		return false, nil
+	}
+	return true, nr.check(ns)
+}
+
+// Route returns the address of the node, an empty one if it is not
+// registered and the state of a registered one
+func (nr *NodeRegistry) Route(name string) (host, port string, err error) {
+	nr.lock.Lock()
+	defer nr.lock.Unlock()
+	ns, ok := nr.nodes[name]
+	if !ok {
+		return
+	}
+	if err = nr.check(ns); err != nil {
+		return
+	}
+	host, port, err = net.SplitHostPort(ns.Addr)
+	return
+}
+
+// List returns the registered nodes by name
+func (nr *NodeRegistry) List() []NodeStatus {
+	nr.lock.Lock()
+	defer nr.lock.Unlock()
+	list := make([]NodeStatus, 0, len(nr.nodes))
+	for _, ns := range nr.nodes {
+		s := *ns
+		s.Status = "up"
+		if err := nr.check(ns); err != nil {
+			s.Status = err.Error()
+		}
+		s.Drained = nr.drained[ns.Name]
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// NodesHandler takes the heartbeats of the backends under /nodes/, they
+// must carry the token as "Authorization: Bearer <token>" and a heartbeat
+// the client certificate of its node, it is served like TunnelHandler:
+//
+//	POST /nodes/heartbeat  a Node as json
+//	GET  /nodes/           the registered nodes
+func NodesHandler(nr *NodeRegistry, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nodes/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var n Node
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&n)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if n.Name == "" {
+			http.Error(w, "name required", http.StatusBadRequest)
+			return
+		}
+		if _, _, err := net.SplitHostPort(n.Addr); err != nil {
+			http.Error(w, "addr: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// the token is shared, a node speaks only for itself
+		if err := peerNode(r, n.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		nr.Heartbeat(n)
+		writeJSON(w, map[string]bool{"drained": nr.drainedNode(n.Name)})
+	})
+	mux.HandleFunc("/nodes/", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, nr.List())
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (nr *NodeRegistry) drainedNode(name string) bool {
+	nr.lock.Lock()
+	defer nr.lock.Unlock()
+	return nr.drained[name]
+}
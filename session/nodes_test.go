@@ -0,0 +1,57 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNodeRoute(t *testing.T) {
+	up := map[string]bool{"local": true}
+	for _, tc := range []struct {
+		name  string
+		node  Node
+		drain bool
+		seen  time.Duration
+		host  string
+		err   error
+	}{
+		{"up", Node{Addr: "10.0.0.1:9000", Engines: up}, false, 0, "10.0.0.1", nil},
+		{"expired", Node{Addr: "10.0.0.1:9000", Engines: up}, false, -time.Minute, "", ErrNodeDown},
+		{"no engine", Node{Addr: "10.0.0.1:9000"}, false, 0, "", ErrNodeDown},
+		{"engines down", Node{Addr: "10.0.0.1:9000", Engines: map[string]bool{"local": false}}, false, 0, "", ErrNodeDown},
+		{"one engine up", Node{Addr: "10.0.0.1:9000", Engines: map[string]bool{"local": false, "remote": true}}, false, 0, "10.0.0.1", nil},
+		{"draining", Node{Addr: "10.0.0.1:9000", Engines: up, Draining: true}, false, 0, "", ErrNodeDraining},
+		{"drained", Node{Addr: "10.0.0.1:9000", Engines: up}, true, 0, "", ErrNodeDraining},
+		{"full", Node{Addr: "10.0.0.1:9000", Engines: up, Capacity: 2, Running: 2}, false, 0, "", ErrNodeFull},
+		{"room left", Node{Addr: "10.0.0.1:9000", Engines: up, Capacity: 2, Running: 1}, false, 0, "10.0.0.1", nil},
+	} {
+		nr := NewNodeRegistry(30 * time.Second)
+		tc.node.Name = "node-1"
+		nr.Heartbeat(tc.node)
+		nr.nodes["node-1"].Seen = nr.nodes["node-1"].Seen.Add(tc.seen)
+		nr.Drain("node-1", tc.drain)
+		host, port, err := nr.Route("node-1")
+		if host != tc.host || err != tc.err || (err == nil && port != "9000") {
+			t.Errorf("%s: got %q %q %v", tc.name, host, port, err)
+		}
+	}
+}
+
+func TestNodeUnregistered(t *testing.T) {
+	nr := NewNodeRegistry(30 * time.Second)
+	if host, _, err := nr.Route("node-1"); host != "" || err != nil {
+		t.Fatalf("unregistered node: %q %v", host, err)
+	}
+	if registered, _ := nr.Status("node-1"); registered {
+		t.Fatal("unregistered node registered")
+	}
+	nr.Heartbeat(Node{Name: "node-1", Addr: "10.0.0.1:9000"})
+	if registered, err := nr.Status("node-1"); !registered || err != ErrNodeDown {
+		t.Fatalf("node without engines: %v %v", registered, err)
+	}
+	nr.Drain("node-1", true)
+	nr.Drain("node-1", false)
+	if nr.drainedNode("node-1") {
+		t.Fatal("drain not lifted")
+	}
+}
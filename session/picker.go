@@ -0,0 +1,437 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/wukezhan/rainbow/api"
+	"github.com/wukezhan/ssh"
+
+	color "github.com/logrusorgru/aurora"
+)
+
+const (
+	_altScreen   = "\x1b[?1049h\x1b[?25l"
+	_mainScreen  = "\x1b[?25h\x1b[?1049l"
+	_clearLine   = "\x1b[K"
+	_pickRefresh = 5 * time.Second
+)
+
+// group modes of the picker
+const (
+	groupNone = iota
+	groupNode
+	groupPod
+)
+
+var groupNames = []string{"none", "node", "pod"}
+
+// picker keys, decoded from the raw input
+const (
+	keyNone = iota
+	keyUp
+	keyDown
+	keyPageUp
+	keyPageDown
+	keyEnter
+	keyTab
+	keyBackspace
+	keyQuit
+	keyRune
+)
+
+type pickKey struct {
+	kind int
+	r    rune
+}
+
+type pickRow struct {
+	head   bool
+	header string
+	t      target
+}
+
+// picker is a full-screen container picker drawn inside the relay shell
+type picker struct {
+	sess   *Instance
+	keys   chan pickKey
+	redraw chan struct{}
+	done   chan struct{}
+
+	lock   sync.Mutex
+	items  []target
+	health map[string]error
+	query  string
+	group  int
+	cursor int
+	top    int
+}
+
+// fuzzy reports if every rune of query appears in s in order
+func fuzzy(s, query string) bool {
+	s = strings.ToLower(s)
+	for _, r := range strings.ToLower(query) {
+		i := strings.IndexRune(s, r)
+		if i < 0 {
+			return false
+		}
+		s = s[i+1:]
+	}
+	return true
+}
+
+// decodeKeys turns a raw input chunk into picker keys, rest is an
+// incomplete character at its end, left for the next chunk
+func decodeKeys(p []byte) (keys []pickKey, rest []byte) {
+	keys = []pickKey{}
+	for len(p) > 0 {
+		switch {
+		case bytes.HasPrefix(p, []byte("\x1b[A")), bytes.HasPrefix(p, []byte("\x1bOA")):
+			keys, p = append(keys, pickKey{kind: keyUp}), p[3:]
+		case bytes.HasPrefix(p, []byte("\x1b[B")), bytes.HasPrefix(p, []byte("\x1bOB")):
+			keys, p = append(keys, pickKey{kind: keyDown}), p[3:]
+		case bytes.HasPrefix(p, []byte("\x1b[5~")):
+			keys, p = append(keys, pickKey{kind: keyPageUp}), p[4:]
+		case bytes.HasPrefix(p, []byte("\x1b[6~")):
+			keys, p = append(keys, pickKey{kind: keyPageDown}), p[4:]
+		case bytes.HasPrefix(p, []byte("\x1b[")), bytes.HasPrefix(p, []byte("\x1bO")):
+			// unsupported sequence, skip up to its final byte
+			i := 2
+			for i < len(p) && (p[i] < 0x40 || p[i] > 0x7e) {
+				i++
+			}
+			if i < len(p) {
+				i++
+			}
+			p = p[i:]
+		case p[0] == 0x1b, p[0] == 0x03:
+			keys, p = append(keys, pickKey{kind: keyQuit}), p[1:]
+		case p[0] == 0x10:
+			keys, p = append(keys, pickKey{kind: keyUp}), p[1:]
+		case p[0] == 0x0e:
+			keys, p = append(keys, pickKey{kind: keyDown}), p[1:]
+		case p[0] == '\r', p[0] == '\n':
+			keys, p = append(keys, pickKey{kind: keyEnter}), p[1:]
+		case p[0] == '\t':
+			keys, p = append(keys, pickKey{kind: keyTab}), p[1:]
+		case p[0] == 0x7f, p[0] == 0x08:
+			keys, p = append(keys, pickKey{kind: keyBackspace}), p[1:]
+		case p[0] < 0x20:
+			p = p[1:]
+		case !utf8.FullRune(p):
+			return keys, p
+		default:
+			r, size := utf8.DecodeRune(p)
+			if r != utf8.RuneError || size > 1 {
+				keys = append(keys, pickKey{kind: keyRune, r: r})
+			}
+			p = p[size:]
+		}
+	}
+	return keys, nil
+}
+
+func newPicker(sess *Instance) *picker {
+	return &picker{
+		sess:   sess,
+		keys:   make(chan pickKey, 64),
+		redraw: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		items:  sess.targets(),
+		health: map[string]error{},
+		group:  groupNode,
+	}
+}
+
+// pipe takes over the relay input while the picker runs
+func (pk *picker) pipe(r *bufio.Reader) ([]byte, error) {
+	p := make([]byte, 1024)
+	var rest []byte
+	var keys []pickKey
+	for {
+		n, err := r.Read(p)
+		if err != nil {
+			return append(rest, p[:n]...), err
+		}
+		rest = append(rest, p[:n]...)
+		select {
+		case <-pk.done:
+			// the picker opened a container, hand the input over
+			if pk.sess.BIO != nil {
+				pk.sess.writeInput(rest)
+				return nil, nil
+			}
+			return rest, nil
+		default:
+		}
+		keys, rest = decodeKeys(rest)
+		// run may have returned with keys still queued, drop the rest
+	send:
+		for _, k := range keys {
+			select {
+			case pk.keys <- k:
+			case <-pk.done:
+				break send
+			}
+		}
+	}
+}
+
+// resize redraws the picker on window changes
+func (pk *picker) resize(win ssh.Window) {
+	select {
+	case pk.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// refresh reloads the containers and node health in the background, into
+// the picker only, the session cache belongs to the session goroutine
+func (pk *picker) refresh() {
+	ticker := time.NewTicker(_pickRefresh)
+	defer ticker.Stop()
+	for {
+		nodes := map[string]bool{}
+		uns := []api.UserNode{}
+		pk.lock.Lock()
+		for _, t := range pk.items {
+			if !nodes[t.uc.NodeName] {
+				nodes[t.uc.NodeName] = true
+				uns = append(uns, api.UserNode{NodeName: t.uc.NodeName})
+			}
+		}
+		pk.lock.Unlock()
+		health := nodesHealth(uns)
+		err, ucs := pk.sess.api().GetContainers(pk.sess.User.Name)
+		select {
+		case <-pk.done:
+			return
+		default:
+		}
+		pk.lock.Lock()
+		pk.health = health
+		if err == nil {
+			pk.items = containerTargets(ucs)
+		}
+		pk.lock.Unlock()
+		pk.resize(pk.sess.win)
+
+		select {
+		case <-ticker.C:
+		case <-pk.done:
+			return
+		}
+	}
+}
+
+// rows returns the filtered items, sorted and with the group headers
+func (pk *picker) rows() []pickRow {
+	items := []target{}
+	for _, t := range pk.items {
+		if fuzzy(t.String(), pk.query) {
+			items = append(items, t)
+		}
+	}
+	key := func(t target) string {
+		switch pk.group {
+		case groupNode:
+			return t.uc.NodeName
+		case groupPod:
+			return t.uc.PodName
+		}
+		return ""
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return key(items[i]) < key(items[j])
+	})
+	rows := []pickRow{}
+	last := ""
+	for i, t := range items {
+		if pk.group != groupNone && (i == 0 || key(t) != last) {
+			last = key(t)
+			rows = append(rows, pickRow{head: true, header: last})
+		}
+		rows = append(rows, pickRow{t: t})
+	}
+	return rows
+}
+
+// move moves the cursor by delta selectable rows
+func (pk *picker) move(rows []pickRow, delta int) {
+	step := 1
+	if delta < 0 {
+		step, delta = -1, -delta
+	}
+	for ; delta > 0; delta-- {
+		i := pk.cursor + step
+		for i >= 0 && i < len(rows) && rows[i].head {
+			i += step
+		}
+		if i < 0 || i >= len(rows) {
+			return
+		}
+		pk.cursor = i
+	}
+}
+
+func pad(s string, width int) string {
+	rs := []rune(s)
+	if len(rs) > width {
+		return string(rs[:width])
+	}
+	return s + strings.Repeat(" ", width-len(rs))
+}
+
+// draw renders the whole screen
+func (pk *picker) draw(rows []pickRow) {
+	width, height := pk.sess.win.Width, pk.sess.win.Height
+	if width <= 0 {
+		width = 80
+	}
+	if height <= 0 {
+		height = 24
+	}
+	body := height - 3
+	if body < 1 {
+		body = 1
+	}
+	if pk.cursor >= 0 && pk.cursor < pk.top {
+		pk.top = pk.cursor
+	}
+	if pk.cursor >= pk.top+body {
+		pk.top = pk.cursor - body + 1
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+	buf.WriteString(color.Bold(pad(fmt.Sprintf(" filter: %s_   group: %s",
+		pk.query, groupNames[pk.group]), width)).String() + _clearLine + "\r\n")
+	col := (width - 12) / 3
+	if col < 8 {
+		col = 8
+	}
+	buf.WriteString(color.BrightBlack(pad("   "+pad("NODE", col)+pad("POD", col)+pad("CONTAINER", col)+"STATUS", width)).String() + _clearLine + "\r\n")
+	for i := pk.top; i < pk.top+body; i++ {
+		if i >= len(rows) {
+			buf.WriteString(_clearLine + "\r\n")
+			continue
+		}
+		row := rows[i]
+		if row.head {
+			buf.WriteString(color.Blue(pad(" "+row.header, width)).Bold().String() + _clearLine + "\r\n")
+			continue
+		}
+		status := healthLabel(pk.health[row.t.uc.NodeName])
+		if _, ok := pk.health[row.t.uc.NodeName]; !ok {
+			status = color.BrightBlack("● ?").String()
+		}
+		line := pad(row.t.uc.NodeName, col) + pad(row.t.uc.PodName, col) + pad(row.t.container, col)
+		if i == pk.cursor {
+			buf.WriteString(color.Inverse(" > "+line).String() + " " + status + _clearLine + "\r\n")
+		} else {
+			buf.WriteString("   " + line + " " + status + _clearLine + "\r\n")
+		}
+	}
+	buf.WriteString(color.BrightBlack(pad(" ↑↓ move  tab group  enter open  esc quit", width)).String() + _clearLine)
+	pk.sess.UIO.Write(buf.Bytes())
+}
+
+// first moves the cursor to the first selectable row, -1 if none
+func (pk *picker) first(rows []pickRow) {
+	pk.cursor = -1
+	pk.top = 0
+	pk.move(rows, 1)
+}
+
+// run draws the picker until an item is selected or the user quits
+func (pk *picker) run() (t target, ok bool) {
+	go pk.refresh()
+	rows := pk.rows()
+	pk.first(rows)
+	for {
+		pk.lock.Lock()
+		pk.draw(rows)
+		pk.lock.Unlock()
+
+		select {
+		case <-pk.redraw:
+			pk.lock.Lock()
+			rows = pk.rows()
+			if pk.cursor >= len(rows) || (pk.cursor >= 0 && rows[pk.cursor].head) {
+				pk.first(rows)
+			}
+			pk.lock.Unlock()
+		case k := <-pk.keys:
+			pk.lock.Lock()
+			filter := false
+			switch k.kind {
+			case keyUp:
+				pk.move(rows, -1)
+			case keyDown:
+				pk.move(rows, 1)
+			case keyPageUp:
+				pk.move(rows, -(pk.sess.win.Height - 3))
+			case keyPageDown:
+				pk.move(rows, pk.sess.win.Height-3)
+			case keyTab:
+				pk.group = (pk.group + 1) % len(groupNames)
+				filter = true
+			case keyBackspace:
+				if q := []rune(pk.query); len(q) > 0 {
+					pk.query = string(q[:len(q)-1])
+				}
+				filter = true
+			case keyRune:
+				pk.query += string(k.r)
+				filter = true
+			case keyEnter:
+				if pk.cursor >= 0 && pk.cursor < len(rows) {
+					t, ok = rows[pk.cursor].t, true
+				}
+			}
+			if filter {
+				rows = pk.rows()
+				pk.first(rows)
+			}
+			pk.lock.Unlock()
+			if ok || k.kind == keyQuit {
+				return
+			}
+		}
+	}
+}
+
+// Pick shows the full-screen picker and opens the selected container
+func (sess *Instance) Pick() {
+	if len(sess.containers) == 0 {
+		sess.refreshContainers()
+	}
+	pk := newPicker(sess)
+	sess.block.Lock()
+	sess.picker = pk
+	sess.block.Unlock()
+
+	sess.UIO.Write([]byte(_altScreen))
+	sess.ri.SetPrompt("")
+	sess.ri.Terminal.PipeWrite = pk.pipe
+	sess.ri.Terminal.KickRead()
+	t, ok := pk.run()
+
+	sess.block.Lock()
+	sess.picker = nil
+	sess.block.Unlock()
+	close(pk.done)
+	sess.ri.Terminal.PipeWrite = nil
+	sess.UIO.Write([]byte(_mainScreen))
+	sess.SetPrompt()
+	if ok {
+		sess.writeLines("goto " + t.String())
+		sess.open(t.uc, t.container)
+	}
+}
@@ -0,0 +1,53 @@
+package session
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecodeKeys(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []pickKey
+		rest string
+	}{
+		{"\x1b[A\x1bOB\x1b[5~\x1b[6~", []pickKey{{kind: keyUp}, {kind: keyDown}, {kind: keyPageUp}, {kind: keyPageDown}}, ""},
+		{"\x10\x0e\r\n\t\x7f\x08", []pickKey{{kind: keyUp}, {kind: keyDown}, {kind: keyEnter}, {kind: keyEnter}, {kind: keyTab}, {kind: keyBackspace}, {kind: keyBackspace}}, ""},
+		{"\x1b", []pickKey{{kind: keyQuit}}, ""},
+		{"\x03", []pickKey{{kind: keyQuit}}, ""},
+		// unsupported sequences and control bytes are dropped
+		{"\x1b[1;5Ca\x01", []pickKey{{kind: keyRune, r: 'a'}}, ""},
+		{"w中", []pickKey{{kind: keyRune, r: 'w'}, {kind: keyRune, r: '中'}}, ""},
+		// a character split across reads is left for the next one
+		{"w\xe4\xb8", []pickKey{{kind: keyRune, r: 'w'}}, "\xe4\xb8"},
+		// invalid bytes are skipped
+		{"\xffa\xe4a", []pickKey{{kind: keyRune, r: 'a'}, {kind: keyRune, r: 'a'}}, ""},
+	} {
+		keys, rest := decodeKeys([]byte(tc.in))
+		if len(keys) != len(tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.in, keys, tc.want)
+			continue
+		}
+		for i := range keys {
+			if keys[i] != tc.want[i] {
+				t.Errorf("%q: got %v, want %v", tc.in, keys, tc.want)
+				break
+			}
+		}
+		if !bytes.Equal(rest, []byte(tc.rest)) {
+			t.Errorf("%q: rest %q, want %q", tc.in, rest, tc.rest)
+		}
+	}
+}
+
+func TestDecodeKeysSplit(t *testing.T) {
+	in := []byte("中")
+	keys, rest := decodeKeys(in[:2])
+	if len(keys) != 0 {
+		t.Fatalf("got %v from half a character", keys)
+	}
+	keys, rest = decodeKeys(append(rest, in[2:]...))
+	if len(keys) != 1 || keys[0].r != '中' || len(rest) != 0 {
+		t.Fatalf("got %v, rest %q", keys, rest)
+	}
+}
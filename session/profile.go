@@ -0,0 +1,253 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/wukezhan/rainbow/api"
+	"github.com/wukezhan/readline"
+
+	color "github.com/logrusorgru/aurora"
+)
+
+// ProfileDir keeps the history, favourites and aliases of every user,
+// nothing is persisted when empty
+var ProfileDir = ""
+
+// HistoryLimit is the max number of history lines kept per user
+var HistoryLimit = 1000
+
+var profileLock sync.Mutex
+
+// Profile is the per user data of the relay shell
+type Profile struct {
+	Favs    []string          `json:"favs"`
+	Aliases map[string]string `json:"aliases"`
+}
+
+// profileName escapes a username for file names, distinct usernames get
+// distinct names and the usual ones are kept as is
+func profileName(username string) string {
+	return url.PathEscape(username)
+}
+
+// historyFile returns the history file of the user, empty if not persisted
+func historyFile(username string) string {
+	if ProfileDir == "" {
+		return ""
+	}
+	if err := os.MkdirAll(ProfileDir, 0700); err != nil {
+		return ""
+	}
+	return filepath.Join(ProfileDir, profileName(username)+".history")
+}
+
+func loadProfile(username string) *Profile {
+	p := &Profile{
+		Aliases: map[string]string{},
+	}
+	if ProfileDir == "" {
+		return p
+	}
+	data, err := ioutil.ReadFile(filepath.Join(ProfileDir, profileName(username)+".json"))
+	if err == nil {
+		json.Unmarshal(data, p)
+	}
+	if p.Aliases == nil {
+		p.Aliases = map[string]string{}
+	}
+	return p
+}
+
+func (p *Profile) save(username string) error {
+	if ProfileDir == "" {
+		return nil
+	}
+	err := os.MkdirAll(ProfileDir, 0700)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(ProfileDir, profileName(username)+".json")
+	err = ioutil.WriteFile(path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// updateProfile reloads the profile, so concurrent sessions of the user
+// do not overwrite each other, applies fn and saves it
+func (sess *Instance) updateProfile(fn func(p *Profile)) error {
+	profileLock.Lock()
+	defer profileLock.Unlock()
+	p := loadProfile(sess.User.Name)
+	fn(p)
+	sess.profile = p
+	return p.save(sess.User.Name)
+}
+
+// expand replaces a leading alias of line by its command
+func (sess *Instance) expand(line string) string {
+	if sess.profile == nil {
+		return line
+	}
+	fields := strings.SplitN(line, " ", 2)
+	cmd, ok := sess.profile.Aliases[fields[0]]
+	if !ok {
+		return line
+	}
+	if len(fields) > 1 {
+		cmd += " " + fields[1]
+	}
+	return cmd
+}
+
+// profileItems completes `fav` and `alias`
+func (sess *Instance) profileItems() []readline.PrefixCompleterInterface {
+	favs := readline.PcItemDynamic(func(line string) []string {
+		if sess.profile == nil {
+			return nil
+		}
+		return sess.profile.Favs
+	})
+	aliases := readline.PcItemDynamic(func(line string) []string {
+		names := []string{}
+		if sess.profile != nil {
+			for name := range sess.profile.Aliases {
+				names = append(names, name)
+			}
+		}
+		return names
+	})
+	return []readline.PrefixCompleterInterface{
+		readline.PcItem("fav",
+			readline.PcItem("add", sess.targetItems()...),
+			readline.PcItem("rm", favs),
+			readline.PcItem("list"),
+		),
+		readline.PcItem("alias",
+			readline.PcItem("rm", aliases),
+			readline.PcItem("list"),
+		),
+	}
+}
+
+// listFavs prints the favourites, they can be opened with `N` afterwards
+func (sess *Instance) listFavs() {
+	if len(sess.profile.Favs) == 0 {
+		sess.writeLines("no favourites, add one with `fav add <pod/container@node>`")
+		return
+	}
+	ucs := []api.UserContainer{}
+	for _, fav := range sess.profile.Favs {
+		pod, container, node := parseTarget(fav)
+		ucs = append(ucs, api.UserContainer{
+			PodName:    pod,
+			NodeName:   node,
+			Containers: []string{container},
+		})
+	}
+	for i, fav := range sess.profile.Favs {
+		sess.ri.Write([]byte(fmt.Sprintf("\r%s) %s\n",
+			color.Green(i+1).Bold().String(),
+			color.Red(fav).String(),
+		)))
+	}
+	sess.ucs = ucs
+}
+
+// Fav handles `fav add <target>|rm <target|N>|list`
+func (sess *Instance) Fav(line string) {
+	args := strings.Fields(line)
+	if len(args) < 2 || args[1] == "list" {
+		sess.listFavs()
+		return
+	}
+	usage := "fav add <pod/container@node>|rm <pod/container@node|N>|list"
+	if len(args) != 3 {
+		sess.writeLines(usage)
+		return
+	}
+	var err error
+	switch args[1] {
+	case "add":
+		if len(sess.containers) == 0 {
+			sess.refreshContainers()
+		}
+		ts := sess.resolve(args[2])
+		if len(ts) != 1 {
+			sess.writeLines(fmt.Sprintf("%d containers match %s", len(ts), args[2]))
+			return
+		}
+		name := ts[0].String()
+		err = sess.updateProfile(func(p *Profile) {
+			for _, fav := range p.Favs {
+				if fav == name {
+					return
+				}
+			}
+			p.Favs = append(p.Favs, name)
+		})
+		sess.writeLines("favourite added: " + name)
+	case "rm":
+		err = sess.updateProfile(func(p *Profile) {
+			idx, e := strconv.Atoi(args[2])
+			for i, fav := range p.Favs {
+				if fav == args[2] || (e == nil && i == idx-1) {
+					p.Favs = append(p.Favs[:i], p.Favs[i+1:]...)
+					return
+				}
+			}
+		})
+	default:
+		sess.writeLines(usage)
+	}
+	if err != nil {
+		sess.writeLines("save favourites error: " + err.Error())
+	}
+}
+
+// Alias handles `alias <name> <command>|rm <name>|list`
+func (sess *Instance) Alias(line string) {
+	args := strings.Fields(line)
+	if len(args) < 2 || args[1] == "list" {
+		names := []string{}
+		for name := range sess.profile.Aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			sess.writeLines(color.Magenta(name).Bold().String() + " => " + sess.profile.Aliases[name])
+		}
+		return
+	}
+	var err error
+	switch {
+	case args[1] == "rm" && len(args) == 3:
+		err = sess.updateProfile(func(p *Profile) {
+			delete(p.Aliases, args[2])
+		})
+	case len(args) >= 3 && args[1] != "rm":
+		name, cmd := args[1], strings.Join(args[2:], " ")
+		err = sess.updateProfile(func(p *Profile) {
+			p.Aliases[name] = cmd
+		})
+	default:
+		sess.writeLines("alias <name> <command>|rm <name>|list, e.g. `alias db goto pod/container@node`")
+	}
+	if err != nil {
+		sess.writeLines("save aliases error: " + err.Error())
+	}
+}
@@ -0,0 +1,53 @@
+package session
+
+import (
+	"errors"
+
+	"github.com/wukezhan/rainbow/rbac"
+)
+
+// Policy is the access control policy, nil allows everything
+var Policy *rbac.Policy
+
+// groups returns the groups of the user, loaded once
+func (sess *Instance) groups() []string {
+	sess.ulock.Lock()
+	defer sess.ulock.Unlock()
+	if sess.User.Groups == nil {
+		sess.User.Groups = []string{}
+		err, ugs := sess.api().GetGroups(sess.User.Name)
+		if err != nil {
+			sess.Log.Warn("groups", "user", sess.User.Name, "error", err)
+		}
+		for _, ug := range ugs {
+			sess.User.Groups = append(sess.User.Groups, ug.GroupName)
+		}
+	}
+	return sess.User.Groups
+}
+
+// authorize checks the exec of dc against the Policy, the labels are
+// not known here so the backend checks it again
+func (sess *Instance) authorize(dc *Docker) (rbac.Decision, error) {
+	req := rbac.Request{
+		User:      sess.User.Name,
+		Node:      dc.NodeName,
+		Pod:       dc.PodName,
+		Container: dc.ContainerName,
+		Role:      dc.RoleName,
+		Cmd:       dc.Cmd,
+		Mode:      rbac.ModeTTY,
+	}
+	if dc.sftp {
+		req.Mode = rbac.ModeSFTP
+	}
+	if Policy != nil {
+		req.Groups = sess.groups()
+	}
+	d := Policy.Decide(req)
+	if !d.Allowed {
+		sess.Log.Warn("rbac denied", "user", sess.User.Name, "target", dc.target(), "rule", d.Rule, "reason", d.Reason)
+		return d, errors.New("permission denied: " + d.Reason)
+	}
+	return d, nil
+}
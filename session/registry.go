@@ -0,0 +1,63 @@
+package session
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// registry holds the live sessions, from New to Exit
+var registry = struct {
+	sync.Mutex
+	sessions map[*Instance]struct{}
+}{sessions: map[*Instance]struct{}{}}
+
+var modeNames = map[int]string{
+	Init:     "Init",
+	Relay:    "Relay",
+	TTY:      "TTY",
+	RelayTTY: "RelayTTY",
+	SFTP:     "SFTP",
+}
+
+func register(sess *Instance) {
+	registry.Lock()
+	registry.sessions[sess] = struct{}{}
+	registry.Unlock()
+}
+
+// unregister reports if sess was still registered
+func unregister(sess *Instance) bool {
+	registry.Lock()
+	defer registry.Unlock()
+	_, ok := registry.sessions[sess]
+	delete(registry.sessions, sess)
+	return ok
+}
+
+// sessionsDesc is collected from the registry on every scrape, as
+// the kind and mode of a session change along the way
+var sessionsDesc = prometheus.NewDesc("rainbow_sessions_active",
+	"Active sessions by kind and mode.", []string{"kind", "mode"}, nil)
+
+type sessionsCollector struct{}
+
+func (sessionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionsDesc
+}
+
+func (sessionsCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := map[[2]string]int{}
+	registry.Lock()
+	for sess := range registry.sessions {
+		counts[[2]string{sess.Kind, modeNames[sess.Mode]}]++
+	}
+	registry.Unlock()
+	for k, n := range counts {
+		ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.GaugeValue, float64(n), k[0], k[1])
+	}
+}
+
+func init() {
+	prometheus.MustRegister(sessionsCollector{})
+}
@@ -1,11 +1,10 @@
 package session
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/url"
 	"regexp"
 	"strconv"
@@ -14,6 +13,7 @@ import (
 	"time"
 
 	"github.com/wukezhan/rainbow/api"
+	"github.com/wukezhan/rainbow/rlog"
 	"github.com/wukezhan/readline"
 	"github.com/wukezhan/ssh"
 
@@ -32,6 +32,8 @@ type UIO interface {
 	// Close .
 	WritePipe() (err error)
 	Close() (err error)
+	// Terminate shows msg to the user and ends the session
+	Terminate(msg string) (err error)
 	Kind() string
 }
 
@@ -62,10 +64,25 @@ type User struct {
 	ID   int
 	Name string
 	Mail string
+	// Key is the public key the user logged in with, nil for websocket users
+	Key ssh.PublicKey
+	// Groups are loaded only when a policy needs them
+	Groups []string
 }
 
 // Instance .
 type Instance struct {
+	// active is the last input or output, in unix nanoseconds
+	active int64
+	// bytes relayed to and from the containers
+	bytesIn  int64
+	bytesOut int64
+	// ID identifies the session in the logs, of the backends too
+	ID    string
+	Log   *slog.Logger
+	Ctx   context.Context
+	span  *rlog.Span
+	Start time.Time
 	Kind  string
 	User  User
 	ri    *readline.Instance
@@ -77,6 +94,23 @@ type Instance struct {
 	ulock sync.Mutex
 	block sync.Mutex
 	Mode  int
+	// ucs is the last listed containers, indexed by the `N.M` syntax
+	ucs []api.UserContainer
+	// containers caches the containers of the user, for `goto`
+	containers []api.UserContainer
+	picker     *picker
+	// windows of the relay, window is the active one
+	windows  []*Window
+	window   *Window
+	windowID int
+	prefixed bool
+	profile  *Profile
+	// Cmd is run first by the relay shell, e.g. an alias given as ssh command
+	Cmd string
+	// dest is the pod/container@node of a direct TTY or SFTP session
+	dest string
+	// RemoteIP is the address of the user
+	RemoteIP string
 }
 
 //
@@ -93,8 +127,13 @@ const _clear = "\x1b[H\x1b[J"
 // New .
 func New() *Instance {
 	sess := Instance{
+		ID:    rlog.NewID(8),
 		Winch: make(chan ssh.Window, 1),
+		Start: time.Now(),
 	}
+	sess.Log = rlog.With("session", sess.ID)
+	sess.Ctx, sess.span = rlog.Start(context.Background(), sess.Log, "session")
+	register(&sess)
 
 	return &sess
 }
@@ -123,7 +162,10 @@ func (sess *Instance) SetPrompt() {
 
 // Exit .
 func (sess *Instance) Exit() {
-	//defer log.Println("ss exited")
+	if unregister(sess) {
+		sess.span.End(nil)
+	}
+	sess.CloseWindows()
 	sess.CloseBIO()
 	sess.CloseUIO()
 }
@@ -137,26 +179,32 @@ func (sess *Instance) ShowUsage() {
 
 // Completer .
 func (sess *Instance) Completer() *readline.PrefixCompleter {
-	return readline.NewPrefixCompleter(
+	pc := readline.NewPrefixCompleter(
 		readline.PcItem("help"),
 		readline.PcItem("list",
 			readline.PcItem("pod"),
-			/*readline.PcItem("node"),
-			readline.PcItem("group"),*/
+			readline.PcItem("node"),
+			readline.PcItem("group"),
 		),
-		/*readline.PcItem("goto",
-			readline.PcItemDynamic(func(s string) []string {
-				return []string{"hello"}
-				//return []string{ss.s.User() + ".test", ss.s.User() + ".demo"}
-			}),
-		),*/
+		sess.keysItem(),
+		sess.gotoItem(),
+		sess.windowItem(),
+		sess.broadcastItem(),
+		readline.PcItem("pick"),
 		readline.PcItem("exit"),
 	)
+	pc.SetChildren(append(pc.GetChildren(), sess.profileItems()...))
+	return pc
+}
+
+// api returns an api client tracing in the session
+func (sess *Instance) api() *api.Api {
+	return api.New().WithContext(sess.Ctx)
 }
 
 //CloseBIO .
 func (sess *Instance) CloseBIO() {
-	log.Println("bio closed")
+	sess.Log.Debug("bio closed")
 	sess.block.Lock()
 	defer sess.block.Unlock()
 	if sess.BIO != nil {
@@ -174,25 +222,36 @@ func (sess *Instance) CloseUIO() {
 	sess.UIO.Close()
 }
 
-//TTY .
-func (sess *Instance) TTY(args url.Values) {
-	var err error
-	sess.BIO = &Docker{
+// newDocker returns the backend of the container in args, not dialed yet
+func (sess *Instance) newDocker(args url.Values) BIO {
+	bio := &Docker{
 		Sess: sess,
 	}
 	host := args.Get("host")
 	if host == "" {
 		host = "localhost"
 	}
-	sess.BIO.Init(map[string]string{
+	bio.Init(map[string]string{
 		"UserName":      sess.User.Name,
-		"RoleName":      "root",
+		"RoleName":      args.Get("role"), // empty for the default of the policy
 		"ContainerName": args.Get("name"),
 		"PodName":       args.Get("pod"), // pass
 		"NodeName":      host,            // pass
 		"NodeHost":      host,            // pass
+		"Engine":        args.Get("engine"),
 		"Cmd":           args.Get("cmd"), // config
 	})
+	return bio
+}
+
+//TTY .
+func (sess *Instance) TTY(args url.Values) {
+	var err error
+	sess.BIO = sess.newDocker(args)
+	host := args.Get("host")
+	if host == "" {
+		host = "localhost"
+	}
 	err = sess.BIO.Dial()
 	if err != nil {
 		sess.UIO.Write([]byte("\rlogin error: " + err.Error() + "\r\n"))
@@ -201,12 +260,14 @@ func (sess *Instance) TTY(args url.Values) {
 	}
 	name := args.Get("name") + "@" + host
 	if args.Get("pod") != "" {
-		name = args.Get("pod") + ":" + name
+		name = args.Get("pod") + "/" + name
 	}
 	sess.UIO.Write([]byte("\rlogin to " + name + "\r\n"))
 
 	sess.BIO.Write([]byte("\n"))
 	if sess.ri == nil {
+		sess.dest = name
+		defer sess.watch()()
 		errs := make(chan error, 2)
 		go func() {
 			errs <- func() error {
@@ -227,40 +288,21 @@ func (sess *Instance) TTY(args url.Values) {
 			}()
 		}()
 		err := <-errs
-		log.Println("err", err)
+		sess.Log.Info("tty closed", "target", name, "error", err)
 	} else {
-		go func() {
-			defer func() {
-				//log.Println("backend -> user close")
-				sess.CloseBIO()
-			}()
-			err := sess.UIO.WritePipe()
-			log.Println("err", err)
-		}()
-		sess.ri.SetPrompt("")
-		sess.ri.Terminal.PipeWrite = func(r *bufio.Reader) ([]byte, error) {
-			//sess.BIO.Write([]byte(string(r)))
-			p := make([]byte, 1024)
-			for {
-				n, err := r.Read(p)
-				if err != nil {
-					return p[:n], err
-				}
-				if sess.BIO != nil {
-					sess.BIO.Write(p[:n])
-				} else {
-					return p[:n], nil
-				}
-			}
-		}
+		sess.attach(sess.newWindow(name, sess.BIO))
 	}
 }
 
 // Relay .
 func (sess *Instance) Relay() {
+	sess.Mode = Relay
+	sess.profile = loadProfile(sess.User.Name)
 	sess.pc = sess.Completer()
 	config := &readline.Config{
 		AutoComplete:        sess.pc,
+		HistoryFile:         historyFile(sess.User.Name),
+		HistoryLimit:        HistoryLimit,
 		InterruptPrompt:     "^C",
 		EOFPrompt:           "exit",
 		HistorySearchFold:   true,
@@ -293,6 +335,9 @@ func (sess *Instance) Relay() {
 					if sess.BIO != nil {
 						sess.BIO.ResizeTTY(win)
 					}
+					if sess.picker != nil {
+						sess.picker.resize(win)
+					}
 					sess.block.Unlock()
 				case <-ctx.Done():
 					return
@@ -313,25 +358,30 @@ func (sess *Instance) Relay() {
 	)))
 	l.Write([]byte(color.Green("# type `help` to get started!\r\n").String()))
 	sess.SetPrompt()
+	defer sess.watch()()
 	var line string
-	var ucs []api.UserContainer
-	ra := api.New()
-	err, ucs = ra.GetContainers(sess.User.Name)
+	ra := sess.api()
+	err, sess.ucs = ra.GetContainers(sess.User.Name)
+	sess.containers = sess.ucs
 	for {
-		line, err = l.Readline()
-		if err == readline.ErrInterrupt {
-			if len(line) == 0 {
+		if sess.Cmd != "" {
+			line, sess.Cmd = sess.Cmd, ""
+		} else {
+			line, err = l.Readline()
+			if err == readline.ErrInterrupt {
+				if len(line) == 0 {
+					break
+				} else {
+					continue
+				}
+			} else if err == io.EOF {
 				break
-			} else {
-				continue
 			}
-		} else if err == io.EOF {
-			break
 		}
 
-		line = strings.TrimSpace(line)
+		line = sess.expand(strings.TrimSpace(line))
 		//log.Println("line:", line)
-		if len(ucs) > 0 {
+		if len(sess.ucs) > 0 {
 			m, e := regexp.MatchString("^((\\d+)|(\\d+)\\.(\\d+))$", strings.Trim(line, " "))
 			//log.Println("match?", m, e)
 			if e == nil && m {
@@ -339,7 +389,7 @@ func (sess *Instance) Relay() {
 				is := strings.SplitN(strings.Trim(line, " "), ".", 2)
 				idx, e := strconv.Atoi(is[0])
 				if e != nil {
-					log.Println("id error:", e.Error())
+					sess.Log.Debug("id error", "error", e)
 					l.Write([]byte("\rinvalid id\n"))
 					continue
 				}
@@ -351,27 +401,17 @@ func (sess *Instance) Relay() {
 						continue
 					}
 				}
-				if e != nil || idx > len(ucs) || idx < 1 {
+				if e != nil || idx > len(sess.ucs) || idx < 1 {
 					l.Write([]byte("\rinvalid id\r\n"))
 					continue
 				}
-				uc := ucs[idx-1]
+				uc := sess.ucs[idx-1]
 				if idx2 >= len(uc.Containers) {
 					l.Write([]byte("\rinvalid id\r\n"))
 					continue
 				}
-				name := uc.Containers[idx2]
-				if uc.PodName != "" {
-					name = name + "_" + uc.PodName
-				}
-				params := url.Values{
-					"host": []string{uc.NodeName},
-					"pod":  []string{uc.PodName},
-					"name": []string{uc.Containers[idx2]},
-					"cmd":  []string{"bash"},
-				}
-				log.Println(uc)
-				sess.TTY(params)
+				sess.Log.Debug("open", "pod", uc.PodName, "node", uc.NodeName)
+				sess.open(uc, uc.Containers[idx2])
 				//l.Write([]byte("\rgoto " + name + "@" + uc.NodeName + "\r\n"))
 				continue
 			}
@@ -388,61 +428,38 @@ func (sess *Instance) Relay() {
 			sess.ShowUsage()
 		case strings.HasPrefix(line, "setprompt"):
 			if len(line) <= 10 {
-				log.Println("setprompt <prompt>")
+				l.Write([]byte("\rsetprompt <prompt>\r\n"))
 				break
 			}
 			l.SetPrompt(line[10:])
 		case strings.HasPrefix(line, "list"):
+			l.Write([]byte("\r"))
 			if strings.Contains(line, "group") {
+				sess.listGroups()
 			} else if strings.Contains(line, "node") {
+				sess.listNodes()
 			} else {
-				l.Write([]byte("\r"))
-				err, ucs = ra.GetContainers(sess.User.Name)
+				err, sess.ucs = ra.GetContainers(sess.User.Name)
 				if err == nil {
-					ul := len(ucs)
-					i := 0
-					for i < ul {
-						uc := ucs[i]
-						i++
-						if len(uc.Containers) > 0 {
-							l.Write([]byte(fmt.Sprintf(
-								"\r%s) %s@%s 🐳\n",
-								color.Green(i).Bold().String(),
-								color.Magenta(uc.PodName).Bold(),
-								color.Blue(uc.NodeName).Bold(),
-							)))
-							for idx := 0; idx < len(uc.Containers); idx++ {
-								name := uc.Containers[idx]
-								l.Write([]byte(fmt.Sprintf(
-									"\r    %s.%s) %s\n",
-									color.Green(i).Bold().String(),
-									color.Green(idx).Bold().String(),
-									color.Red(name).String(),
-								)))
-							}
-						} else {
-							/*name := uc.Containers[0]
-							if uc.PodName != "" {
-								name = name + "~" + uc.PodName
-							}
-							l.Write([]byte(fmt.Sprintf(
-								"\r%s) %s@%s\n", //  💎
-								color.Green(i).Bold().String(),
-								color.Magenta(name).Bold(),
-								color.Blue(uc.NodeName).Bold(),
-							)))*/
-						}
-						//l.Write([]byte(uc.PodName + ":" + uc.Containers[0] + "\n"))
-					}
+					sess.containers = sess.ucs
+					sess.listPods(sess.ucs, 0)
 				}
 			}
-		case strings.HasPrefix(line, "goto"):
+		case line == "keys" || strings.HasPrefix(line, "keys "):
+			sess.Keys(line)
+		case line == "goto" || strings.HasPrefix(line, "goto "):
 			//l.Write([]byte(_clear + "\n"))
-			sess.Mode = RelayTTY
-			sess.TTY(url.Values{
-				"name": []string{line[5:]},
-				"cmd":  []string{"bash"}, // @TODO pass by params
-			})
+			sess.Goto(line)
+		case line == "window" || strings.HasPrefix(line, "window "):
+			sess.Windows(line)
+		case line == "broadcast" || strings.HasPrefix(line, "broadcast "):
+			sess.StartBroadcast(line)
+		case line == "fav" || strings.HasPrefix(line, "fav "):
+			sess.Fav(line)
+		case line == "alias" || strings.HasPrefix(line, "alias "):
+			sess.Alias(line)
+		case line == "pick":
+			sess.Pick()
 		case line == "clear":
 			l.Write([]byte(_clear))
 			l.Operation.ForceRefresh()
@@ -480,12 +497,14 @@ func (sess *Instance) SFTP() {
 		"NodeHost":      "dx-dev-test176",           // @TODO pass
 		"Cmd":           "/usr/lib/ssh/sftp-server", // config
 	})
+	sess.dest = sess.User.Name + "/data@dx-dev-test176"
 	err = sess.BIO.Dial()
 	if err != nil {
 		sess.UIO.Write([]byte("error:" + err.Error()))
 		sess.CloseUIO()
 		return
 	}
+	defer sess.watch()()
 
 	errs := make(chan error, 2)
 	go func() {
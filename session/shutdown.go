@@ -0,0 +1,47 @@
+package session
+
+import (
+	"context"
+	"time"
+
+	color "github.com/logrusorgru/aurora"
+)
+
+// live returns the registered sessions
+func live() []*Instance {
+	registry.Lock()
+	defer registry.Unlock()
+	sessions := make([]*Instance, 0, len(registry.sessions))
+	for sess := range registry.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+// Notify writes a banner to the user
+func (sess *Instance) Notify(msg string) {
+	sess.UIO.WriteString("\r\n" + color.Brown("[rainbow] "+msg).Bold().String() + "\r\n")
+}
+
+// Shutdown shows msg to every session and waits for them to end until
+// ctx is done, the remaining ones are terminated then
+func Shutdown(ctx context.Context, msg string) {
+	sessions := live()
+	for _, sess := range sessions {
+		sess.Notify(msg)
+	}
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for len(sessions) > 0 {
+		select {
+		case <-ticker.C:
+			sessions = live()
+		case <-ctx.Done():
+			for _, sess := range live() {
+				sess.Log.Info("session terminated by shutdown")
+				sess.Expire("server shut down")
+			}
+			return
+		}
+	}
+}
@@ -1,9 +1,7 @@
 package session
 
 import (
-	"encoding/base64"
-	"log"
-
+	"github.com/wukezhan/rainbow/term"
 	"github.com/wukezhan/ssh"
 )
 
@@ -38,14 +36,13 @@ func (ss *SSHSess) WritePipe() (err error) {
 	}()
 	initResized := false
 	var p []byte
-	var q []byte
 	bio := ss.Sess.BIO
 	bioKind := bio.Kind()
 	for {
 		if bioKind == "docker" {
 			_, p, err = bio.Read()
 			if err != nil {
-				log.Println("exited", err)
+				ss.Sess.Log.Debug("backend read end", "error", err)
 				return
 			}
 			if ss.Sess.Mode == SFTP {
@@ -57,12 +54,12 @@ func (ss *SSHSess) WritePipe() (err error) {
 					bio.ResizeTTY(ss.Sess.win)
 					initResized = true
 				}
-				q, err = base64.StdEncoding.DecodeString(string(p[1:]))
-				if err != nil {
-					return
+				if len(p) == 0 || p[0] != term.Output {
+					continue
 				}
-				_, err = ss.Write(q)
+				_, err = ss.Write(p[1:])
 			}
+			ss.Sess.touch()
 			if err != nil {
 				return
 			}
@@ -80,6 +77,7 @@ func (ss *SSHSess) WritePipe() (err error) {
 
 func (ss *SSHSess) Read(buf []byte) (n int, err error) {
 	n, err = ss.Ss.Read(buf)
+	ss.Sess.touch()
 	return
 }
 
@@ -92,6 +90,12 @@ func (ss *SSHSess) Close() (err error) {
 	return
 }
 
+// Terminate .
+func (ss *SSHSess) Terminate(msg string) (err error) {
+	ss.WriteString("\r\n" + msg + "\r\n")
+	return ss.Close()
+}
+
 // Kind .
 func (ss *SSHSess) Kind() string {
 	return "ssh"
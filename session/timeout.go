@@ -0,0 +1,197 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// Timeouts is the session lifetime policy, nil means no limits
+var Timeouts *TimeoutPolicy
+
+// timeoutTick is how often the limits are checked
+const timeoutTick = 5 * time.Second
+
+// timeoutWarn is how long before expiry the user is warned
+const timeoutWarn = time.Minute
+
+// Limits of a session, zero or empty means unlimited
+type Limits struct {
+	Idle string `json:"idle"`
+	Max  string `json:"max"`
+
+	idle time.Duration
+	max  time.Duration
+}
+
+// TimeoutPolicy maps users, groups and targets to limits, a session
+// gets the strictest of every matching entry
+type TimeoutPolicy struct {
+	Default Limits            `json:"default"`
+	Users   map[string]Limits `json:"users"`
+	Groups  map[string]Limits `json:"groups"`
+	// Targets are pod/container@node glob patterns
+	Targets map[string]Limits `json:"targets"`
+}
+
+func (l *Limits) parse() (err error) {
+	if l.Idle != "" {
+		l.idle, err = time.ParseDuration(l.Idle)
+		if err != nil {
+			return
+		}
+	}
+	if l.Max != "" {
+		l.max, err = time.ParseDuration(l.Max)
+	}
+	return
+}
+
+func stricter(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func (l Limits) merge(o Limits) Limits {
+	l.idle = stricter(l.idle, o.idle)
+	l.max = stricter(l.max, o.max)
+	return l
+}
+
+// LoadTimeouts .
+func LoadTimeouts(file string) (*TimeoutPolicy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tp := &TimeoutPolicy{}
+	err = json.Unmarshal(data, tp)
+	if err != nil {
+		return nil, err
+	}
+	err = tp.Default.parse()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range []map[string]Limits{tp.Users, tp.Groups, tp.Targets} {
+		for k, l := range m {
+			err = l.parse()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", k, err)
+			}
+			m[k] = l
+		}
+	}
+	return tp, nil
+}
+
+// limits returns the limits of user on the targets
+func (tp *TimeoutPolicy) limits(user User, targets []string) Limits {
+	l := tp.Default
+	if ul, ok := tp.Users[user.Name]; ok {
+		l = l.merge(ul)
+	}
+	for _, g := range user.Groups {
+		if gl, ok := tp.Groups[g]; ok {
+			l = l.merge(gl)
+		}
+	}
+	for pattern, tl := range tp.Targets {
+		for _, t := range targets {
+			if ok, _ := path.Match(pattern, t); ok {
+				l = l.merge(tl)
+				break
+			}
+		}
+	}
+	return l
+}
+
+// touch records input or output activity
+func (sess *Instance) touch() {
+	atomic.StoreInt64(&sess.active, time.Now().UnixNano())
+}
+
+func (sess *Instance) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&sess.active)))
+}
+
+// openTargets lists the targets the session is logged into
+func (sess *Instance) openTargets() []string {
+	sess.block.Lock()
+	defer sess.block.Unlock()
+	targets := []string{}
+	if sess.dest != "" {
+		targets = append(targets, sess.dest)
+	}
+	for _, w := range sess.windows {
+		targets = append(targets, w.Name)
+	}
+	return targets
+}
+
+// watch enforces the Timeouts policy until the returned func is called
+func (sess *Instance) watch() func() {
+	stop := make(chan struct{})
+	if Timeouts == nil {
+		return func() {}
+	}
+	sess.touch()
+	if len(Timeouts.Groups) > 0 {
+		sess.groups()
+	}
+	go func() {
+		ticker := time.NewTicker(timeoutTick)
+		defer ticker.Stop()
+		warned := time.Time{}
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			l := Timeouts.limits(sess.User, sess.openTargets())
+			var left time.Duration
+			reason := ""
+			if l.max > 0 {
+				left = l.max - time.Since(sess.Start)
+				reason = "maximum session duration of " + l.max.String() + " reached"
+			}
+			if l.idle > 0 && (l.max == 0 || l.idle-sess.idle() < left) {
+				left = l.idle - sess.idle()
+				reason = "idle for " + l.idle.String()
+			}
+			if reason == "" {
+				continue
+			}
+			if left <= 0 {
+				sess.Log.Info("session expired", "user", sess.User.Name, "reason", reason)
+				sess.Expire("session expired: " + reason)
+				return
+			}
+			if left <= timeoutWarn && time.Since(warned) > timeoutWarn {
+				warned = time.Now()
+				sess.Notify(fmt.Sprintf("%s, this session ends in %ds", reason, int(left.Seconds())))
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+	}
+}
+
+// Expire ends the session with msg, the backend execs are closed
+func (sess *Instance) Expire(msg string) {
+	sess.CloseWindows()
+	sess.block.Lock()
+	if sess.BIO != nil {
+		sess.BIO.Close()
+	}
+	sess.block.Unlock()
+	sess.UIO.Terminate(msg)
+}
@@ -0,0 +1,119 @@
+package session
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/hashicorp/yamux"
+	"github.com/wukezhan/rainbow/mtls"
+	"github.com/wukezhan/rainbow/rlog"
+)
+
+// TunnelUpgrade is the Upgrade header of a backend opening its tunnel
+const TunnelUpgrade = "rainbow-tunnel"
+
+// tunnels are the backends connected out to this relay, by node name.
+// The relay is the yamux client, it opens a stream per exec
+var tunnels = struct {
+	sync.Mutex
+	m map[string]*yamux.Session
+}{m: map[string]*yamux.Session{}}
+
+// tunnel returns the open tunnel of node, nil if it has none
+func tunnel(node string) *yamux.Session {
+	tunnels.Lock()
+	defer tunnels.Unlock()
+	ts := tunnels.m[node]
+	if ts != nil && ts.IsClosed() {
+		delete(tunnels.m, node)
+		return nil
+	}
+	return ts
+}
+
+// tunnelDial opens a stream to the backend of node, the dialed address is
+// not used
+func tunnelDial(ts *yamux.Session) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		return ts.Open()
+	}
+}
+
+// peerNode checks r comes with a client certificate issued for node, the
+// backends name themselves and the token is shared by all of them
+func peerNode(r *http.Request, node string) error {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return errors.New("node certificate required")
+	}
+	return mtls.Allowed(r.TLS.VerifiedChains[0][0], []string{node})
+}
+
+// TunnelHandler takes the tunnels of the backends behind NAT. A backend
+// sends "GET /tunnel" with "Upgrade: rainbow-tunnel", its node name in
+// "X-Rainbow-Node" and the token as "Authorization: Bearer <token>", the
+// connection carries yamux once switched. It must be served with tls and
+// mtls.Peer, the backend presents the certificate of its node name
+func TunnelHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		node := r.Header.Get("X-Rainbow-Node")
+		if node == "" || r.Header.Get("Upgrade") != TunnelUpgrade {
+			http.Error(w, "bad tunnel request", http.StatusBadRequest)
+			return
+		}
+		if err := peerNode(r, node); err != nil {
+			rlog.Logger.Warn("tunnel refused", "node", node, "remote", r.RemoteAddr, "error", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "hijack not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, brw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+		_, err = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: " + TunnelUpgrade + "\r\nConnection: Upgrade\r\n\r\n")
+		if err == nil {
+			err = brw.Flush()
+		}
+		if err != nil {
+			conn.Close()
+			return
+		}
+		ts, err := yamux.Client(conn, nil)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		log := rlog.With("node", node, "remote", r.RemoteAddr)
+		log.Info("tunnel open")
+		tunnels.Lock()
+		// a reconnecting backend replaces its broken tunnel, the streams
+		// of the old one end with it
+		old := tunnels.m[node]
+		tunnels.m[node] = ts
+		tunnels.Unlock()
+		if old != nil {
+			old.Close()
+		}
+		go func() {
+			<-ts.CloseChan()
+			tunnels.Lock()
+			if tunnels.m[node] == ts {
+				delete(tunnels.m, node)
+			}
+			tunnels.Unlock()
+			log.Info("tunnel closed")
+		}()
+	})
+}
@@ -0,0 +1,346 @@
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/wukezhan/rainbow/term"
+	"github.com/wukezhan/readline"
+
+	color "github.com/logrusorgru/aurora"
+)
+
+// WindowPrefix is the prefix key of the window commands, Ctrl-B
+const WindowPrefix = 0x02
+
+// windowBufSize is the output kept per window to redraw the screen
+const windowBufSize = 64 * 1024
+
+// Window is a backend connection of the relay, only the active one
+// is drawn, the others keep buffering their output
+type Window struct {
+	ID   int
+	Name string
+	BIO  BIO
+	sess *Instance
+	buf  []byte
+	lock sync.Mutex
+}
+
+// newWindow adds a window for bio and starts pumping its output
+func (sess *Instance) newWindow(name string, bio BIO) *Window {
+	sess.block.Lock()
+	sess.windowID++
+	w := &Window{
+		ID:   sess.windowID,
+		Name: name,
+		BIO:  bio,
+		sess: sess,
+	}
+	sess.windows = append(sess.windows, w)
+	sess.block.Unlock()
+
+	go func() {
+		err := w.pump()
+		sess.Log.Debug("window closed", "window", w.ID, "error", err)
+		sess.closeWindow(w)
+	}()
+	return w
+}
+
+// pump reads the backend output into the buffer, and to the user if active
+func (w *Window) pump() error {
+	initResized := false
+	for {
+		_, p, err := w.BIO.Read()
+		if err != nil {
+			return err
+		}
+		if !initResized && w.BIO.IsTTY() {
+			// 必须在 exec attached 之后才能 resize，否则可能触发 no such exec 错误
+			w.BIO.ResizeTTY(w.sess.win)
+			initResized = true
+		}
+		if len(p) == 0 {
+			continue
+		}
+		if p[0] != term.Output {
+			if w.active() && w.sess.UIO.Kind() == "ws" {
+				w.sess.UIO.WriteWebtty(p)
+			}
+			continue
+		}
+		q := p[1:]
+		w.lock.Lock()
+		w.buf = append(w.buf, q...)
+		if len(w.buf) > windowBufSize {
+			w.buf = w.buf[len(w.buf)-windowBufSize:]
+		}
+		w.lock.Unlock()
+		w.sess.touch()
+		if w.active() {
+			_, err = w.sess.UIO.Write(q)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (w *Window) active() bool {
+	w.sess.block.Lock()
+	defer w.sess.block.Unlock()
+	return w.sess.window == w
+}
+
+// redraw clears the screen and replays the buffered output
+func (w *Window) redraw() {
+	w.lock.Lock()
+	buf := append([]byte(_clear), w.buf...)
+	w.lock.Unlock()
+	if len(buf) > len(_clear) {
+		w.sess.UIO.Write(buf)
+	}
+	// let full-screen apps repaint themselves
+	w.BIO.ResizeTTY(w.sess.win)
+}
+
+// pipeInput forwards the relay input to the active window
+func (sess *Instance) pipeInput(r *bufio.Reader) ([]byte, error) {
+	p := make([]byte, 1024)
+	for {
+		n, err := r.Read(p)
+		if err != nil {
+			return p[:n], err
+		}
+		if sess.BIO == nil {
+			return p[:n], nil
+		}
+		sess.writeInput(p[:n])
+		if sess.BIO == nil {
+			// detached by a window command
+			return nil, nil
+		}
+	}
+}
+
+// writeInput writes user input to the active window, handling the prefix key
+func (sess *Instance) writeInput(p []byte) {
+	if !sess.windowInput(p) && sess.BIO != nil {
+		sess.BIO.Write(p)
+	}
+}
+
+// windowInput handles the prefix key commands, it returns false
+// when p is not for a window and should go to the backend as is
+func (sess *Instance) windowInput(p []byte) bool {
+	sess.block.Lock()
+	w := sess.window
+	sess.block.Unlock()
+	if w == nil {
+		return false
+	}
+	start := 0
+	for i, b := range p {
+		if !sess.prefixed {
+			if b == WindowPrefix {
+				if i > start {
+					w.BIO.Write(p[start:i])
+				}
+				sess.prefixed = true
+			}
+			continue
+		}
+		sess.prefixed = false
+		start = i + 1
+		switch {
+		case b == WindowPrefix:
+			w.BIO.Write([]byte{WindowPrefix})
+		case b == 'n':
+			sess.switchWindow(1)
+			return true
+		case b == 'p':
+			sess.switchWindow(-1)
+			return true
+		case b >= '0' && b <= '9':
+			if ww := sess.findWindow(int(b - '0')); ww != nil {
+				sess.attach(ww)
+			}
+			return true
+		case b == 'x':
+			w.BIO.Close()
+			return true
+		case b == 'w':
+			sess.detach()
+			sess.listWindows()
+			return true
+		case b == 'c', b == 'd':
+			sess.detach()
+			if b == 'c' {
+				sess.writeLines(color.Green("# choose the target of the new window with `goto`, `pick` or `N.M`").String())
+			}
+			return true
+		}
+	}
+	if !sess.prefixed && start < len(p) {
+		w.BIO.Write(p[start:])
+	}
+	return true
+}
+
+func (sess *Instance) findWindow(id int) *Window {
+	sess.block.Lock()
+	defer sess.block.Unlock()
+	for _, w := range sess.windows {
+		if w.ID == id {
+			return w
+		}
+	}
+	return nil
+}
+
+// switchWindow activates the window delta positions away from the active one
+func (sess *Instance) switchWindow(delta int) {
+	sess.block.Lock()
+	l := len(sess.windows)
+	if l == 0 {
+		sess.block.Unlock()
+		return
+	}
+	idx := 0
+	for i, w := range sess.windows {
+		if w == sess.window {
+			idx = i
+		}
+	}
+	w := sess.windows[((idx+delta)%l+l)%l]
+	sess.block.Unlock()
+	sess.attach(w)
+}
+
+// attach makes w the active window
+func (sess *Instance) attach(w *Window) {
+	sess.block.Lock()
+	sess.window = w
+	sess.BIO = w.BIO
+	sess.block.Unlock()
+	sess.Mode = RelayTTY
+	sess.ri.SetPrompt("")
+	sess.ri.Terminal.PipeWrite = sess.pipeInput
+	w.redraw()
+}
+
+// detach goes back to the relay shell, leaving the windows running
+func (sess *Instance) detach() {
+	sess.block.Lock()
+	sess.window = nil
+	sess.BIO = nil
+	sess.block.Unlock()
+	sess.Mode = Relay
+	sess.ri.Terminal.PipeWrite = nil
+	sess.UIO.Write([]byte(_clear))
+	sess.SetPrompt()
+}
+
+// closeWindow removes w, switching to another window if w was active
+func (sess *Instance) closeWindow(w *Window) {
+	w.BIO.Close()
+	sess.block.Lock()
+	for i, ww := range sess.windows {
+		if ww == w {
+			sess.windows = append(sess.windows[:i], sess.windows[i+1:]...)
+			break
+		}
+	}
+	active := sess.window == w
+	var next *Window
+	if l := len(sess.windows); l > 0 {
+		next = sess.windows[l-1]
+	}
+	sess.block.Unlock()
+	if !active {
+		return
+	}
+	if next != nil {
+		sess.attach(next)
+	} else {
+		sess.detach()
+	}
+}
+
+// CloseWindows closes every window
+func (sess *Instance) CloseWindows() {
+	sess.block.Lock()
+	windows := append([]*Window{}, sess.windows...)
+	sess.block.Unlock()
+	for _, w := range windows {
+		w.BIO.Close()
+	}
+}
+
+// listWindows prints the windows, the active one marked with *
+func (sess *Instance) listWindows() {
+	sess.block.Lock()
+	defer sess.block.Unlock()
+	if len(sess.windows) == 0 {
+		sess.writeLines("no windows")
+		return
+	}
+	for _, w := range sess.windows {
+		mark := " "
+		if w == sess.window {
+			mark = "*"
+		}
+		sess.writeLines(fmt.Sprintf("%s%s) %s", mark,
+			color.Green(w.ID).Bold().String(),
+			color.Red(w.Name).String(),
+		))
+	}
+}
+
+// windowItem completes the `window` command
+func (sess *Instance) windowItem() readline.PrefixCompleterInterface {
+	return readline.PcItem("window",
+		readline.PcItem("list"),
+		readline.PcItem("close"),
+	)
+}
+
+// Windows handles `window list|<id>|close <id>`
+func (sess *Instance) Windows(line string) {
+	args := strings.Fields(line)
+	if len(args) < 2 || args[1] == "list" {
+		sess.listWindows()
+		return
+	}
+	usage := "window list|<id>|close <id>, in a window press Ctrl-B then c,d,n,p,w,x or 0-9"
+	if args[1] == "close" {
+		if len(args) != 3 {
+			sess.writeLines(usage)
+			return
+		}
+		id, err := strconv.Atoi(args[2])
+		if err != nil {
+			sess.writeLines(usage)
+			return
+		}
+		if w := sess.findWindow(id); w != nil {
+			w.BIO.Close()
+		}
+		return
+	}
+	id, err := strconv.Atoi(args[1])
+	if err != nil {
+		sess.writeLines(usage)
+		return
+	}
+	w := sess.findWindow(id)
+	if w == nil {
+		sess.writeLines("no such window: " + args[1])
+		return
+	}
+	sess.attach(w)
+}
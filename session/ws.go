@@ -2,20 +2,22 @@ package session
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"log"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/wukezhan/rainbow/rlog"
 	"github.com/wukezhan/rainbow/term"
 	"github.com/wukezhan/ssh"
 )
 
 // WsSess .
 type WsSess struct {
-	Ws       *websocket.Conn
+	Ws *websocket.Conn
+	// Proto is the subprotocol of the client, webtty if empty
+	Proto    string
 	Sess     *Instance
 	p        []byte
 	l        int
@@ -28,13 +30,13 @@ func (ws *WsSess) Write(b []byte) (int, error) {
 	//log.Println("UIO writing")
 	ws.lock.Lock()
 	defer ws.lock.Unlock()
-	writer, err := ws.Ws.NextWriter(websocket.TextMessage)
+	mt, msg := term.OutputMessage(ws.Proto, b)
+	writer, err := ws.Ws.NextWriter(mt)
 	if err != nil {
 		return 0, err
 	}
 	defer writer.Close()
-	safeMessage := base64.StdEncoding.EncodeToString(b)
-	return writer.Write(append([]byte{term.Output}, []byte(safeMessage)...))
+	return writer.Write(msg)
 }
 
 // WriteWebtty .
@@ -44,10 +46,38 @@ func (ws *WsSess) WriteWebtty(b []byte) (n int, err error) {
 	if ws.Ws == nil {
 		return 0, errors.New("ws is nil")
 	}
-	err = ws.Ws.WriteMessage(websocket.TextMessage, b)
+	mt, q, ok := term.ToClient(ws.Proto, b)
+	if !ok {
+		return len(b), nil
+	}
+	err = ws.Ws.WriteMessage(mt, q)
 	return
 }
 
+func (ws *WsSess) writeRaw(b []byte) (n int, err error) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if ws.Ws == nil {
+		return 0, errors.New("ws is nil")
+	}
+	return len(b), ws.Ws.WriteMessage(websocket.TextMessage, b)
+}
+
+// Handshake sends the title, the preferences and the reconnect delay once
+// the client is authenticated, ttyd clients send their size with init
+func (ws *WsSess) Handshake(init term.InitMessage, title string, prefs []byte, reconnect int) error {
+	if init.Columns > 0 && init.Rows > 0 {
+		ws.Sess.win = ssh.Window{Width: init.Columns, Height: init.Rows}
+	}
+	for _, p := range term.InitMessages(title, prefs, reconnect) {
+		_, err := ws.WriteWebtty(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // WriteString .
 func (ws *WsSess) WriteString(str string) (err error) {
 	//log.Println("wstr", str)
@@ -74,6 +104,10 @@ func (ws *WsSess) Read(buf []byte) (n int, err error) {
 			err = e
 			return
 		}
+		p, ok := term.FromClient(ws.Proto, p)
+		if !ok || len(p) == 0 {
+			continue
+		}
 		if p[0] == term.ResizeTerminal {
 			var args struct {
 				Width  int `json:"columns"`
@@ -81,7 +115,7 @@ func (ws *WsSess) Read(buf []byte) (n int, err error) {
 			}
 			err := json.Unmarshal(p[1:], &args)
 			if err == nil {
-				log.Println("win", args, string(p[1:]))
+				ws.Sess.Log.Debug("resize", "columns", args.Width, "rows", args.Height)
 				ws.Sess.Winch <- ssh.Window{
 					Width:  args.Width,
 					Height: args.Height,
@@ -89,15 +123,20 @@ func (ws *WsSess) Read(buf []byte) (n int, err error) {
 			}
 			continue
 		} else if p[0] == term.Ping {
+			ws.WriteWebtty([]byte{term.Pong})
+			// keeps the backend connection busy for the proxies between
 			if ws.Sess.BIO != nil && ws.Sess.BIO.Kind() == "docker" {
-				log.Println("ping")
 				ws.Sess.BIO.Ping()
 			}
 			continue
 		}
+		ws.Sess.touch()
 		if ws.Sess.BIO != nil {
-			log.Println("loop write webtty")
-			ws.Sess.BIO.WriteWebtty(p)
+			if p[0] == term.Input {
+				ws.Sess.writeInput(p[1:])
+			} else {
+				ws.Sess.BIO.WriteWebtty(p)
+			}
 			continue
 		}
 
@@ -117,13 +156,11 @@ func (ws *WsSess) WritePipe() (err error) {
 	if ws.Sess.Mode == TTY {
 		go func() {
 			sess := ws.Sess
-			defer log.Println("winch exit")
 			for {
 				select {
 				case win := <-sess.Winch:
 					sess.win.Width = win.Width
 					sess.win.Height = win.Height
-					log.Println("winch!", win)
 					if ws.bioReady {
 						err = sess.BIO.ResizeTTY(win)
 					}
@@ -148,12 +185,20 @@ func (ws *WsSess) WritePipe() (err error) {
 				ws.bioReady = true
 				bio.ResizeTTY(ws.Sess.win)
 			}
-			log.Println("ws write", p)
-			_, err = ws.WriteWebtty(p)
+			if rlog.Payload {
+				ws.Sess.Log.Debug("ws write", "payload", p)
+			}
+			if ws.Sess.Mode == SFTP {
+				// sftp packets, not webtty
+				_, err = ws.writeRaw(p)
+			} else {
+				_, err = ws.WriteWebtty(p)
+			}
 			if err != nil {
 				//log.Println("ws write error", err)
 				return
 			}
+			ws.Sess.touch()
 		}
 	}
 }
@@ -169,6 +214,24 @@ func (ws *WsSess) Close() (err error) {
 	return
 }
 
+// Terminate writes msg to the terminal, then closes the websocket with it as reason
+func (ws *WsSess) Terminate(msg string) (err error) {
+	ws.WriteString("\r\n" + msg + "\r\n")
+	reason := msg
+	if len(reason) > 123 {
+		// the limit of a control frame payload
+		reason = reason[:123]
+	}
+	ws.lock.Lock()
+	if ws.Ws != nil {
+		ws.Ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason),
+			time.Now().Add(time.Second))
+	}
+	ws.lock.Unlock()
+	return ws.Close()
+}
+
 // Kind .
 func (ws *WsSess) Kind() string {
 	return "ws"
@@ -0,0 +1,399 @@
+package term
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/wukezhan/rainbow/metrics"
+	"github.com/wukezhan/rainbow/rlog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultEngine is the local daemon, used without an engines file
+func DefaultEngine() Engine {
+	return Engine{
+		Name: "local",
+		Host: "unix://" + localSocket(),
+	}
+}
+
+// localSocket is the first docker or podman socket found, rootless podman
+// listens in the runtime dir of the user
+func localSocket() string {
+	sockets := []string{"/var/run/docker.sock", "/run/podman/podman.sock"}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		sockets = append(sockets, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	for _, s := range sockets {
+		if fi, err := os.Stat(s); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			return s
+		}
+	}
+	return sockets[0]
+}
+
+// Engine is a docker daemon reachable by the backend
+type Engine struct {
+	Name string `json:"name"`
+	// Host is unix:///path, tcp://host:port or ssh://user@host:port
+	Host string `json:"host"`
+	// Version pins the api version, e.g. "1.41", it is negotiated with
+	// the daemon if empty
+	Version string `json:"version"`
+	// CA, Cert and Key are the PEM files of a tcp engine with TLS
+	CA   string `json:"ca"`
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// SSHKey and KnownHosts are required by ssh engines, Socket is the
+	// docker socket on the remote host
+	SSHKey     string `json:"ssh_key"`
+	KnownHosts string `json:"known_hosts"`
+	Socket     string `json:"socket"`
+}
+
+// EngineHealth is the last check of an engine
+type EngineHealth struct {
+	Host    string    `json:"host"`
+	Healthy bool      `json:"healthy"`
+	Error   string    `json:"error,omitempty"`
+	Checked time.Time `json:"checked"`
+	// Server is the daemon and its version, e.g. "Podman Engine 4.9.3"
+	Server     string `json:"server,omitempty"`
+	APIVersion string `json:"api_version,omitempty"`
+}
+
+type engine struct {
+	Engine
+	cli    *client.Client
+	health EngineHealth
+	// negotiated is set once the api version is agreed on, the client
+	// is not used before
+	negotiated bool
+}
+
+// Engines is the pool of docker clients, shared by every exec
+type Engines struct {
+	// Default is the engine of the requests without one
+	Default string
+	engines map[string]*engine
+	lock    sync.RWMutex
+}
+
+// LoadEngines reads {"default": name, "engines": [...]}, the local daemon
+// is the only engine if file is empty
+func LoadEngines(file string) (*Engines, error) {
+	conf := struct {
+		Default string   `json:"default"`
+		Engines []Engine `json:"engines"`
+	}{}
+	if file == "" {
+		conf.Engines = []Engine{DefaultEngine()}
+	} else {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewEngines(conf.Default, conf.Engines)
+}
+
+// NewEngines creates a client per engine, the first one is the default
+// if def is empty
+func NewEngines(def string, es []Engine) (*Engines, error) {
+	if len(es) == 0 {
+		return nil, errors.New("no docker engine")
+	}
+	if def == "" {
+		def = es[0].Name
+	}
+	p := &Engines{
+		Default: def,
+		engines: map[string]*engine{},
+	}
+	for _, e := range es {
+		if e.Name == "" {
+			return nil, fmt.Errorf("docker engine %s has no name", e.Host)
+		}
+		if _, ok := p.engines[e.Name]; ok {
+			return nil, fmt.Errorf("docker engine %s defined twice", e.Name)
+		}
+		cli, err := e.client()
+		if err != nil {
+			return nil, fmt.Errorf("docker engine %s: %s", e.Name, err)
+		}
+		p.engines[e.Name] = &engine{
+			Engine: e,
+			cli:    cli,
+			health: EngineHealth{Host: e.Host, Error: "not checked yet"},
+		}
+	}
+	if _, ok := p.engines[def]; !ok {
+		return nil, fmt.Errorf("default docker engine %s not defined", def)
+	}
+	return p, nil
+}
+
+func (e Engine) client() (*client.Client, error) {
+	headers := map[string]string{"User-Agent": "rainbow-0.0.1"}
+	u, err := url.Parse(e.Host)
+	if err != nil {
+		return nil, err
+	}
+	// an empty version is negotiated by Check
+	version := e.Version
+	switch u.Scheme {
+	case "unix":
+		return client.NewClient(e.Host, version, nil, headers)
+	case "tcp":
+		var hc *http.Client
+		if e.Cert != "" || e.CA != "" {
+			tc, err := e.tlsConfig()
+			if err != nil {
+				return nil, err
+			}
+			hc = &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+		}
+		return client.NewClient(e.Host, version, hc, headers)
+	case "ssh":
+		d, err := e.sshDialer(u)
+		if err != nil {
+			return nil, err
+		}
+		hc := &http.Client{Transport: &http.Transport{DialContext: d.dialContext}}
+		// the address is not used, every connection goes through the tunnel
+		return client.NewClient("tcp://"+e.Name+".ssh:2375", version, hc, headers)
+	}
+	return nil, fmt.Errorf("unsupported docker host %s", e.Host)
+}
+
+func (e Engine) tlsConfig() (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if e.CA != "" {
+		pem, err := ioutil.ReadFile(e.CA)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate in " + e.CA)
+		}
+	}
+	if e.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(e.Cert, e.Key)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// sshDialer tunnels the docker connections through one ssh connection,
+// redialed when it breaks
+type sshDialer struct {
+	addr   string
+	socket string
+	config *ssh.ClientConfig
+	conn   *ssh.Client
+	lock   sync.Mutex
+}
+
+func (e Engine) sshDialer(u *url.URL) (*sshDialer, error) {
+	if e.SSHKey == "" || e.KnownHosts == "" {
+		return nil, errors.New("ssh engines need ssh_key and known_hosts")
+	}
+	pem, err := ioutil.ReadFile(e.SSHKey)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := knownhosts.New(e.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+	name := u.User.Username()
+	if name == "" {
+		cu, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		name = cu.Username
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	socket := e.Socket
+	if socket == "" {
+		socket = "/var/run/docker.sock"
+	}
+	return &sshDialer{
+		addr:   addr,
+		socket: filepath.Clean(socket),
+		config: &ssh.ClientConfig{
+			User:            name,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKey,
+			Timeout:         10 * time.Second,
+		},
+	}, nil
+}
+
+func (d *sshDialer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.conn != nil {
+		conn, err := d.conn.Dial("unix", d.socket)
+		if err == nil {
+			return conn, nil
+		}
+		// the tunnel is broken, dial it again
+		d.conn.Close()
+		d.conn = nil
+	}
+	var err error
+	d.conn, err = ssh.Dial("tcp", d.addr, d.config)
+	if err != nil {
+		return nil, err
+	}
+	return d.conn.Dial("unix", d.socket)
+}
+
+// Client returns the client of the engine name, the default one if empty
+func (p *Engines) Client(name string) (*client.Client, error) {
+	if name == "" {
+		name = p.Default
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	e, ok := p.engines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown docker engine %s", name)
+	}
+	if !e.health.Healthy {
+		return nil, fmt.Errorf("docker engine %s is unhealthy: %s", name, e.health.Error)
+	}
+	return e.cli, nil
+}
+
+// Health returns the last check of every engine
+func (p *Engines) Health() map[string]EngineHealth {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	hs := map[string]EngineHealth{}
+	for name, e := range p.engines {
+		hs[name] = e.health
+	}
+	return hs
+}
+
+// Local reports if the execs of the engine name run on this host, their
+// pids may be killed then
+func (p *Engines) Local(name string) bool {
+	if name == "" {
+		name = p.Default
+	}
+	e, ok := p.engines[name]
+	return ok && strings.HasPrefix(e.Host, "unix://")
+}
+
+// Check pings every engine at once, each within timeout. The api version
+// is negotiated on the first successful ping, later ones keep it as the
+// client is in use then
+func (p *Engines) Check(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, e := range p.engines {
+		wg.Add(1)
+		go func(e *engine) {
+			defer wg.Done()
+			ctx, cf := context.WithTimeout(context.Background(), timeout)
+			defer cf()
+			h := EngineHealth{Host: e.Host, Checked: time.Now()}
+			ping, err := e.cli.Ping(ctx)
+			p.lock.RLock()
+			negotiated := e.negotiated
+			h.Server, h.APIVersion = e.health.Server, e.health.APIVersion
+			p.lock.RUnlock()
+			if err == nil && !negotiated {
+				// the client is not handed out before, nothing races
+				e.cli.NegotiateAPIVersionPing(ping)
+				h.APIVersion = e.cli.ClientVersion()
+				h.Server, err = serverName(ctx, e.cli)
+				if err == nil {
+					negotiated = true
+					rlog.Logger.Info("docker engine", "engine", e.Name, "server", h.Server, "api_version", h.APIVersion)
+				}
+			}
+			h.Healthy = err == nil
+			if err != nil {
+				h.Error = err.Error()
+			}
+			p.lock.Lock()
+			e.negotiated = negotiated
+			if h.Healthy != e.health.Healthy {
+				rlog.Logger.Warn("docker engine health changed", "engine", e.Name, "healthy", h.Healthy, "error", h.Error)
+			}
+			e.health = h
+			p.lock.Unlock()
+			up := 0.0
+			if h.Healthy {
+				up = 1
+			}
+			metrics.EngineUp.WithLabelValues(e.Name).Set(up)
+		}(e)
+	}
+	wg.Wait()
+}
+
+// Watch checks the engines every interval until ctx is done, the first
+// check is left to the caller
+func (p *Engines) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.Check(interval / 2)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serverName is the product and version of the daemon, podman reports
+// itself as a component
+func serverName(ctx context.Context, cli *client.Client) (string, error) {
+	v, err := cli.ServerVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range v.Components {
+		if strings.Contains(c.Name, "Podman") {
+			return c.Name + " " + c.Version, nil
+		}
+	}
+	return "Docker Engine " + v.Version, nil
+}
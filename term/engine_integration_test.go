@@ -0,0 +1,123 @@
+package term
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// TestEngineExec runs the exec flow of the backend against a real engine,
+// it is skipped unless RAINBOW_ENGINE is its host, e.g. for podman:
+//
+//	systemctl --user start podman.socket
+//	RAINBOW_ENGINE=unix://$XDG_RUNTIME_DIR/podman/podman.sock go test -run TestEngineExec -v ./term
+//
+// RAINBOW_IMAGE is the image of the test container, alpine by default.
+// The exec is killed as on a remote engine, through another exec
+func TestEngineExec(t *testing.T) {
+	host := os.Getenv("RAINBOW_ENGINE")
+	if host == "" {
+		t.Skip("RAINBOW_ENGINE not set")
+	}
+	image := os.Getenv("RAINBOW_IMAGE")
+	if image == "" {
+		image = "docker.io/library/alpine:3.19"
+	}
+	engines, err := NewEngines("", []Engine{{Name: "test", Host: host}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engines.Check(10 * time.Second)
+	cli, err := engines.Client("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("engine:", engines.Health()["test"].Server, engines.Health()["test"].APIVersion)
+
+	ctx, cf := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cf()
+	r, err := cli.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, r)
+	r.Close()
+	name := "rainbow-test-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	_, err = cli.ContainerCreate(ctx, &container.Config{
+		Image:  image,
+		Cmd:    []string{"sleep", "300"},
+		Labels: map[string]string{"rainbow.test": "1"},
+	}, nil, nil, nil, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.ContainerRemove(context.Background(), name, types.ContainerRemoveOptions{Force: true})
+	if err := cli.ContainerStart(ctx, name, types.ContainerStartOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tty := New().Client(cli)
+	defer tty.Close()
+	gotName, labels, err := tty.DockerInspect(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotName != name || labels["rainbow.test"] != "1" {
+		t.Fatalf("inspect: %q %v", gotName, labels)
+	}
+
+	tty.Cols, tty.Rows = 80, 24
+	err = tty.DockerExecAttach(name, &types.ExecConfig{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          true,
+		Cmd:          []string{"sh"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Hr.Close()
+	expect := func(input, want string) {
+		t.Helper()
+		if _, err := tty.Hr.Conn.Write([]byte(input)); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		buf := make([]byte, 1024)
+		tty.Hr.Conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		for !strings.Contains(out.String(), want) {
+			n, err := tty.Hr.Reader.Read(buf)
+			if err != nil {
+				t.Fatalf("waiting for %q: %v, got %q", want, err, out.String())
+			}
+			out.Write(buf[:n])
+		}
+	}
+	// the size is set at create or by a resize right after the attach
+	expect("stty size\n", "24 80")
+	if err := tty.DockerExecResize(100, 40); err != nil {
+		t.Fatal(err)
+	}
+	expect("stty size\n", "40 100")
+
+	resp, err := cli.ContainerExecInspect(ctx, tty.ID)
+	if err != nil || !resp.Running {
+		t.Fatalf("exec not running: %v", err)
+	}
+	if err := tty.DockerExecKill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = cli.ContainerExecInspect(ctx, tty.ID)
+	if err != nil || resp.Running {
+		t.Fatalf("exec still running: %v", err)
+	}
+}
@@ -2,19 +2,27 @@ package term
 
 import (
 	"context"
-	"encoding/base64"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/versions"
 	"github.com/docker/docker/client"
 	"github.com/gorilla/websocket"
+	"github.com/wukezhan/rainbow/metrics"
+	"github.com/wukezhan/rainbow/rlog"
 )
 
 // ExecConfig ...
@@ -22,42 +30,70 @@ type ExecConfig struct {
 	types.ExecConfig
 }
 
+// ExecTag is the environment variable marking the processes of an exec,
+// the shell and its children inherit it
+const ExecTag = "RAINBOW_EXEC"
+
+// killScript kills the processes whose environment holds $1, it runs in
+// the container with a shell, tr and grep
+const killScript = `for p in /proc/[0-9]*; do tr '\0' '\n' 2>/dev/null < $p/environ | grep -qx "$1" && kill -9 ${p#/proc/}; done`
+
 // DockerTty .
 type DockerTty struct {
-	User   string
-	Role   string
-	ID     string
-	cli    *client.Client
-	Hr     types.HijackedResponse
-	Stdin  io.Reader
-	Stdout io.Writer
-	Stderr io.Writer
+	// Session is the ID of the relay session, for the logs
+	Session string
+	Log     *slog.Logger
+	User    string
+	Role    string
+	ID      string
+	cli     *client.Client
+	Hr      types.HijackedResponse
+	Stdin   io.Reader
+	Stdout  io.Writer
+	Stderr  io.Writer
 
 	Kind     int
 	SFTP     bool
 	Writable bool
 	Cols     int64
 	Rows     int64
+	// Local is set if the exec runs on this host, its pid is killed when
+	// the session ends. The processes of the execs on remote engines are
+	// found by their ExecTag and killed by another exec
+	Local bool
+	// ExitCode of the exec, known with api 1.25 and later
+	ExitCode int
 
 	wc *Wc
+	// container and tag of the exec, to kill it on a remote engine
+	container string
+	tag       string
 
 	Ctx context.Context
-	Cf  context.CancelFunc
+	// Cf cancels Ctx, call Close rather than Cf: SetTimeout replaces it
+	Cf     context.CancelFunc
+	cfLock sync.Mutex
 }
 
 // Wc .
 type Wc struct {
 	Conn *websocket.Conn
+	// Proto is the subprotocol of the client, webtty if empty
+	Proto string
+	lock  sync.Mutex
 }
 
-// ResizeOption .
+// ResizeOption is the payload of a resize, Width and Height from the relay,
+// columns and rows from gotty and ttyd
 type ResizeOption struct {
-	Width  int64
-	Height int64
+	Width   int64
+	Height  int64
+	Columns int64 `json:"columns"`
+	Rows    int64 `json:"rows"`
 }
 
-// Protocols string
-var Protocols = []string{"webtty"}
+// Protocols string, the binary one first as the upgraders pick in order
+var Protocols = []string{WebttyBinary, Webtty, TTYD}
 
 const (
 	// UnknownInput Unknown message type, maybe sent by a bug
@@ -100,12 +136,45 @@ func (wc *Wc) Read(p []byte) (n int, err error) {
 	}
 }
 
+// read3 reads the next message as webtty
 func (wc *Wc) read3() (mt int, p []byte, err error) {
-	return wc.Conn.ReadMessage()
+	for {
+		mt, p, err = wc.Conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var ok bool
+		p, ok = FromClient(wc.Proto, p)
+		if ok {
+			return
+		}
+	}
+}
+
+// ReadInit reads the init message, the client must send it within timeout
+func (wc *Wc) ReadInit(timeout time.Duration) (init InitMessage, err error) {
+	wc.Conn.SetReadDeadline(time.Now().Add(timeout))
+	_, p, err := wc.Conn.ReadMessage()
+	if err != nil {
+		return
+	}
+	wc.Conn.SetReadDeadline(time.Time{})
+	return ParseInit(p)
 }
 
+// Write writes the webtty message data as the proto of the client
 func (wc *Wc) Write(data []byte) (int, error) {
-	writer, err := wc.Conn.NextWriter(websocket.TextMessage)
+	mt, p, ok := ToClient(wc.Proto, data)
+	if !ok {
+		return len(data), nil
+	}
+	return wc.write(mt, p)
+}
+
+func (wc *Wc) write(mt int, data []byte) (int, error) {
+	wc.lock.Lock()
+	defer wc.lock.Unlock()
+	writer, err := wc.Conn.NextWriter(mt)
 	if err != nil {
 		return 0, err
 	}
@@ -117,15 +186,42 @@ func (wc *Wc) Write(data []byte) (int, error) {
 func New() *DockerTty {
 	tty := &DockerTty{
 		Writable: true,
+		Log:      rlog.Logger,
 	}
 	tty.Ctx, tty.Cf = context.WithCancel(context.Background())
 
 	return tty
 }
 
-// Close close the DockerTty
+// SetTimeout ends the DockerTty after d, the exec is killed then. It must
+// be called before Start, Ctx is not guarded
+func (tty *DockerTty) SetTimeout(d time.Duration) {
+	ctx, cf := context.WithTimeout(tty.Ctx, d)
+	tty.cfLock.Lock()
+	defer tty.cfLock.Unlock()
+	parent := tty.Cf
+	tty.Ctx = ctx
+	tty.Cf = func() {
+		cf()
+		parent()
+	}
+}
+
+// Close close the DockerTty, it may be called from any goroutine
 func (tty *DockerTty) Close() {
-	tty.Cf()
+	tty.cfLock.Lock()
+	cf := tty.Cf
+	tty.cfLock.Unlock()
+	cf()
+}
+
+// Notice writes msg to the user terminal, sftp sessions have none
+func (tty *DockerTty) Notice(msg string) error {
+	if tty.wc == nil || tty.SFTP {
+		return nil
+	}
+	_, err := tty.wc.write(OutputMessage(tty.wc.Proto, []byte("\r\n"+msg+"\r\n")))
+	return err
 }
 
 // Stdio .
@@ -150,11 +246,11 @@ func (tty *DockerTty) Wc(wc *Wc) *DockerTty {
 
 // Wc ..
 func (tty *DockerTty) wsHrRead(data []byte) error {
+	metrics.Bytes.WithLabelValues(metrics.Out).Add(float64(len(data)))
 	//log.Println("docker responsed", data)
-	safeMessage := base64.StdEncoding.EncodeToString(data)
-	_, err := tty.wc.Write(append([]byte{Output}, []byte(safeMessage)...))
+	_, err := tty.wc.write(OutputMessage(tty.wc.Proto, data))
 	if err != nil {
-		log.Println("err", err)
+		tty.Log.Debug("ws write error", "error", err)
 		return err
 	}
 
@@ -176,6 +272,7 @@ func (tty *DockerTty) wsWcRead(data []byte) error {
 			return nil
 		}
 
+		metrics.Bytes.WithLabelValues(metrics.In).Add(float64(len(data) - 1))
 		_, err := tty.Hr.Conn.Write(data[1:])
 		if err != nil {
 			//log.Println("read", (data), err.Error())
@@ -189,10 +286,6 @@ func (tty *DockerTty) wsWcRead(data []byte) error {
 		}
 
 	case ResizeTerminal: //
-		if tty.Cols != 0 && tty.Rows != 0 {
-			break
-		}
-
 		if len(data) <= 1 {
 			return errors.New("received malformed remote command for terminal resize: empty payload")
 		}
@@ -200,22 +293,16 @@ func (tty *DockerTty) wsWcRead(data []byte) error {
 		var args ResizeOption
 		err := json.Unmarshal(data[1:], &args)
 		if err != nil {
-			log.Println("resize", err.Error())
+			tty.Log.Warn("resize", "error", err)
 			return err //errors.Wrapf(err, "received malformed data for terminal resize")
 		}
-		rows := tty.Rows
-		if rows == 0 {
-			rows = int64(args.Height)
+		columns, rows := args.Width, args.Height
+		if columns == 0 || rows == 0 {
+			columns, rows = args.Columns, args.Rows
 		}
 
-		columns := tty.Cols
-		if columns == 0 {
-			columns = int64(args.Width)
-		}
-
-		log.Println("resize", columns, rows)
 		err = tty.DockerExecResize(columns, rows)
-		log.Println(err)
+		tty.Log.Debug("resize", "columns", columns, "rows", rows, "error", err)
 	default:
 		return errors.New("unknown message type `" + string(data[0]) + "`")
 	}
@@ -223,41 +310,25 @@ func (tty *DockerTty) wsWcRead(data []byte) error {
 	return nil
 }
 
-func (tty *DockerTty) sendInitMessage() error {
-	windowTitle := []byte("hello world")
-	_, err := tty.wc.Write(append([]byte{SetWindowTitle}, windowTitle...))
-	if err != nil {
-		return err //errors.Wrapf(err, "failed to send window title")
-	}
-
-	if 0 /*wt.reconnect*/ > 0 {
-		reconnect, _ := json.Marshal(1)
-		_, err := tty.wc.Write(append([]byte{SetReconnect}, reconnect...))
+// SendInit sends the title, the preferences and the reconnect delay, the
+// handshake gotty and ttyd clients expect after their init message
+func (tty *DockerTty) SendInit(title string, prefs []byte, reconnect int) error {
+	for _, p := range InitMessages(title, prefs, reconnect) {
+		_, err := tty.wc.Write(p)
 		if err != nil {
-			return err //errors.Wrapf(err, "failed to set reconnect")
+			return err
 		}
 	}
-
-	/*if wt.masterPrefs != nil {
-		err := wt.masterWrite(append([]byte{SetPreferences}, wt.masterPrefs...))
-		if err != nil {
-			return errors.Wrapf(err, "failed to set preferences")
-		}
-	}*/
-
 	return nil
 }
 
 // ttyStart .
 func (tty *DockerTty) ttyStart() error {
-	//tty.sendInitMessage()
-
 	errs := make(chan error, 2)
 
 	defer func() {
-		log.Println("wc exited")
 		err := tty.Hr.CloseWrite()
-		log.Println("close write", err)
+		tty.Log.Debug("wc exited", "close write", err)
 		tty.Hr.Close()
 	}()
 
@@ -265,7 +336,7 @@ func (tty *DockerTty) ttyStart() error {
 		errs <- func() error {
 			var err error
 			var n int
-			defer log.Println("user", tty.User, "docker -> ws close", err)
+			defer func() { tty.Log.Debug("docker -> ws close", "error", err) }()
 			buffer := make([]byte, 1024)
 			for {
 				n, err = tty.Hr.Reader.Read(buffer)
@@ -286,12 +357,12 @@ func (tty *DockerTty) ttyStart() error {
 			var err error
 			var mt int
 			var p []byte
-			defer log.Println("user", tty.User, "ws -> docker close", err)
+			defer func() { tty.Log.Debug("ws -> docker close", "error", err) }()
 			for {
 				//log.Println("ws in")
 				mt, p, err = tty.wc.read3()
 				if err != nil {
-					log.Println("read error", mt, err.Error())
+					tty.Log.Debug("read error", "type", mt, "error", err)
 					return err
 				}
 
@@ -309,7 +380,7 @@ func (tty *DockerTty) ttyStart() error {
 		err = tty.Ctx.Err()
 		return err
 	case err = <-errs:
-		log.Println("wc end", err)
+		tty.Log.Debug("wc end", "error", err)
 		return err
 	}
 }
@@ -319,9 +390,8 @@ func (tty *DockerTty) sftpStart() error {
 	errs := make(chan error, 2)
 
 	defer func() {
-		log.Println("wc exited")
 		err := tty.Hr.CloseWrite()
-		log.Println("close write", err)
+		tty.Log.Debug("wc exited", "close write", err)
 		tty.Hr.Close()
 	}()
 
@@ -329,7 +399,7 @@ func (tty *DockerTty) sftpStart() error {
 		errs <- func() error {
 			var err error
 			var n int
-			defer log.Println("user", tty.User, "docker -> ws close", err)
+			defer func() { tty.Log.Debug("docker -> ws close", "error", err) }()
 			buffer := make([]byte, 1024)
 			var pbuf []byte
 			var bl int
@@ -338,7 +408,7 @@ func (tty *DockerTty) sftpStart() error {
 				if pl < 8 {
 					n, err = tty.Hr.Reader.Read(buffer)
 					if err != nil {
-						log.Println("err", err)
+						tty.Log.Debug("docker read error", "error", err)
 						return err
 					}
 					if len(pbuf) > 0 {
@@ -353,11 +423,13 @@ func (tty *DockerTty) sftpStart() error {
 				}
 				pl = len(pbuf)
 				if pl > bl {
-					n, err = tty.wc.Write(pbuf[:bl])
+					metrics.Bytes.WithLabelValues(metrics.Out).Add(float64(bl))
+					n, err = tty.wc.write(websocket.TextMessage, pbuf[:bl])
 					pbuf = pbuf[bl:]
 					bl = 0
 				} else {
-					n, err = tty.wc.Write(pbuf[:pl])
+					metrics.Bytes.WithLabelValues(metrics.Out).Add(float64(pl))
+					n, err = tty.wc.write(websocket.TextMessage, pbuf[:pl])
 					pbuf = make([]byte, 0)
 					bl -= pl
 				}
@@ -373,12 +445,12 @@ func (tty *DockerTty) sftpStart() error {
 			var err error
 			var mt int
 			var p []byte
-			defer log.Println("user", tty.User, "ws -> docker close", err)
+			defer func() { tty.Log.Debug("ws -> docker close", "error", err) }()
 			for {
 				mt, p, err = tty.wc.Conn.ReadMessage()
 				//log.Println("read from ws", n, buffer[:n], err)
 				if err != nil {
-					log.Println("read error", err.Error())
+					tty.Log.Debug("read error", "error", err)
 					return err
 				}
 
@@ -386,6 +458,7 @@ func (tty *DockerTty) sftpStart() error {
 					continue
 				}
 
+				metrics.Bytes.WithLabelValues(metrics.In).Add(float64(len(p)))
 				_, err = tty.Hr.Conn.Write(p)
 				//log.Println("write to docker", n, err)
 				if err != nil {
@@ -401,7 +474,7 @@ func (tty *DockerTty) sftpStart() error {
 		err = tty.Ctx.Err()
 		return err
 	case err = <-errs:
-		log.Println("wc end", err)
+		tty.Log.Debug("wc end", "error", err)
 		return err
 	}
 }
@@ -410,6 +483,9 @@ func (tty *DockerTty) sftpStart() error {
 type InitMessage struct {
 	Arguments string `json:"Arguments,omitempty"`
 	AuthToken string `json:"AuthToken,omitempty"`
+	// Columns and Rows are the initial size sent by ttyd
+	Columns int `json:"columns,omitempty"`
+	Rows    int `json:"rows,omitempty"`
 }
 
 // Start .
@@ -422,22 +498,37 @@ func (tty *DockerTty) Start() {
 		} else {
 			err = tty.ttyStart()
 		}
-		log.Println("error", err)
-		resp, err := tty.cli.ContainerExecInspect(tty.Ctx, tty.ID)
+		tty.Log.Info("exec end", "exec", tty.ID, "error", err)
+		// tty.Ctx may be done already, e.g. the session expired
+		ctx := context.Background()
+		resp, err := tty.cli.ContainerExecInspect(ctx, tty.ID)
 		if err != nil {
 			// If we can't connect, then the daemon probably died.
-			log.Println(err)
+			tty.Log.Warn("exec inspect", "exec", tty.ID, "error", err)
 		}
+		killed := resp.Running
 		if resp.Running {
-			err = syscall.Kill(resp.Pid, syscall.SIGKILL)
-			log.Println("kill", resp.Pid, err)
+			if tty.Local {
+				err = syscall.Kill(resp.Pid, syscall.SIGKILL)
+				tty.Log.Info("kill", "pid", resp.Pid, "error", err)
+			} else {
+				// the pid is in the namespace of a remote engine
+				err = tty.DockerExecKill(ctx)
+				tty.Log.Info("kill", "exec", tty.ID, "error", err)
+			}
 		}
-		resp, err = tty.cli.ContainerExecInspect(tty.Ctx, tty.ID)
+		resp, err = tty.cli.ContainerExecInspect(ctx, tty.ID)
 		if err != nil {
 			// If we can't connect, then the daemon probably died.
-			log.Println(err)
+			tty.Log.Warn("exec inspect", "exec", tty.ID, "error", err)
+		} else if !resp.Running && tty.supports("1.25") {
+			tty.ExitCode = resp.ExitCode
+			tty.Log.Info("exec exit", "exec", tty.ID, "exit_code", resp.ExitCode)
+			if !killed && resp.ExitCode != 0 {
+				tty.Notice(fmt.Sprintf("[rainbow] exited with code %d", resp.ExitCode))
+			}
 		}
-		tty.Cf()
+		tty.Close()
 	} else {
 		// other kind
 	}
@@ -449,6 +540,24 @@ func (tty *DockerTty) Start() {
 func (tty *DockerTty) DockerInit(host string, version string, httpClient *http.Client, httpHeaders map[string]string) error {
 	var err error
 	tty.cli, err = client.NewClient(host, version, httpClient, httpHeaders)
+	tty.Local = strings.HasPrefix(host, "unix://")
+	return err
+}
+
+// supports reports if the api version of the client reaches version
+func (tty *DockerTty) supports(version string) bool {
+	return versions.GreaterThanOrEqualTo(tty.cli.ClientVersion(), version)
+}
+
+// Client shares cli, e.g. one of the Engines, instead of DockerInit
+func (tty *DockerTty) Client(cli *client.Client) *DockerTty {
+	tty.cli = cli
+	return tty
+}
+
+// DockerPing checks the docker daemon is reachable
+func (tty *DockerTty) DockerPing() error {
+	_, err := tty.cli.Ping(tty.Ctx)
 	return err
 }
 
@@ -461,31 +570,107 @@ func (tty *DockerTty) DockerGetK8sContainers(pod, container string) ([]types.Con
 	})
 }
 
+// DockerInspect returns the name of the container, whatever it was
+// addressed by, and its labels, the image ones included
+func (tty *DockerTty) DockerInspect(id string) (name string, labels map[string]string, err error) {
+	c, err := tty.cli.ContainerInspect(tty.Ctx, id)
+	if err != nil {
+		return "", nil, err
+	}
+	labels = map[string]string{}
+	if c.Config != nil {
+		for k, v := range c.Config.Labels {
+			labels[k] = v
+		}
+	}
+	return strings.TrimPrefix(c.Name, "/"), labels, nil
+}
+
 // DockerExecAttach .
 func (tty *DockerTty) DockerExecAttach(name string, ec *types.ExecConfig) error {
+	sized := false
+	if ec.Tty && tty.Rows > 0 && tty.Cols > 0 && tty.supports("1.42") {
+		// the shell starts with the right size, no resize after its prompt
+		ec.ConsoleSize = &[2]uint{uint(tty.Rows), uint(tty.Cols)}
+		sized = true
+	}
+	tag := make([]byte, 8)
+	if _, err := rand.Read(tag); err != nil {
+		return err
+	}
+	tty.container, tty.tag = name, hex.EncodeToString(tag)
+	ec.Env = append(ec.Env, ExecTag+"="+tty.tag)
+	start := time.Now()
+	_, span := rlog.Start(tty.Ctx, tty.Log, "exec.create", "container", name, "user", ec.User)
 	execID, cerr := tty.cli.ContainerExecCreate(tty.Ctx, name, *ec)
+	metrics.Since(metrics.ExecDuration.WithLabelValues("create"), start)
+	span.End(cerr)
 	if cerr != nil {
+		metrics.ExecErrors.WithLabelValues("create").Inc()
 		return cerr
 	}
 	tty.ID = execID.ID
 	esc := types.ExecStartCheck{
-		Detach: ec.Detach,
-		Tty:    ec.Tty,
+		Detach:      ec.Detach,
+		Tty:         ec.Tty,
+		ConsoleSize: ec.ConsoleSize,
 	}
-	log.Println("DockerExecAttach", tty.ID)
+	tty.Log.Debug("DockerExecAttach", "exec", tty.ID)
 	var aerr error
+	start = time.Now()
+	_, span = rlog.Start(tty.Ctx, tty.Log, "exec.attach", "exec", execID.ID)
 	tty.Hr, aerr = tty.cli.ContainerExecAttach(tty.Ctx, execID.ID, esc)
+	metrics.Since(metrics.ExecDuration.WithLabelValues("attach"), start)
+	span.End(aerr)
 	if aerr != nil {
-		log.Println("exec", aerr.Error())
+		metrics.ExecErrors.WithLabelValues("attach").Inc()
+		tty.Log.Warn("exec attach", "exec", tty.ID, "error", aerr)
 		return aerr
 	}
+	if ec.Tty && !sized && tty.Rows > 0 && tty.Cols > 0 {
+		// older daemons and podman size the exec once it runs
+		if err := tty.DockerExecResize(tty.Cols, tty.Rows); err != nil {
+			tty.Log.Debug("exec resize", "exec", tty.ID, "error", err)
+		}
+	}
 	return nil
 }
 
+// DockerExecKill kills the processes of the exec by another exec in the
+// container, as root, and waits a moment for them to end
+func (tty *DockerTty) DockerExecKill(ctx context.Context) error {
+	if tty.tag == "" {
+		return errors.New("exec not tagged")
+	}
+	ec := types.ExecConfig{
+		User: "0",
+		Cmd:  []string{"sh", "-c", killScript, "sh", ExecTag + "=" + tty.tag},
+	}
+	kill, err := tty.cli.ContainerExecCreate(ctx, tty.container, ec)
+	if err != nil {
+		return err
+	}
+	err = tty.cli.ContainerExecStart(ctx, kill.ID, types.ExecStartCheck{Detach: true})
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 20; i++ {
+		resp, err := tty.cli.ContainerExecInspect(ctx, tty.ID)
+		if err != nil {
+			return err
+		}
+		if !resp.Running {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.New("exec still running")
+}
+
 // DockerExecResize .
 func (tty *DockerTty) DockerExecResize(w, h int64) error {
 	var err error
-	log.Println("DockerExecResize", tty.ID)
+
 	err = tty.cli.ContainerExecResize(tty.Ctx, tty.ID, types.ResizeOptions{
 		Height: uint(h),
 		Width:  uint(w),
@@ -0,0 +1,161 @@
+package term
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// WebttyBinary is webtty in binary messages with raw output, for the
+	// relays and the clients that offer it
+	WebttyBinary = "webtty.binary"
+	// Webtty is the subprotocol of gotty, text messages with a type byte
+	// and base64 output
+	Webtty = "webtty"
+	// TTYD is the subprotocol of ttyd 1.6 and later, binary messages with
+	// raw output
+	TTYD = "tty"
+)
+
+// ttyd messages, translated to and from webtty at the edge
+const (
+	ttydInput       = '0'
+	ttydResize      = '1'
+	ttydPause       = '2'
+	ttydResume      = '3'
+	ttydOutput      = '0'
+	ttydTitle       = '1'
+	ttydPreferences = '2'
+)
+
+// ParseInit reads the init message, the first message of gotty and ttyd
+// clients, both send it as json
+func ParseInit(data []byte) (init InitMessage, err error) {
+	err = json.Unmarshal(data, &init)
+	init.Arguments = strings.TrimLeft(init.Arguments, "?")
+	return
+}
+
+// InitMessages are the webtty messages of the handshake: the window title,
+// the preferences if any and the reconnect delay in seconds if not 0
+func InitMessages(title string, prefs []byte, reconnect int) [][]byte {
+	msgs := [][]byte{append([]byte{SetWindowTitle}, title...)}
+	if len(prefs) > 0 {
+		msgs = append(msgs, append([]byte{SetPreferences}, prefs...))
+	}
+	if reconnect > 0 {
+		msgs = append(msgs, append([]byte{SetReconnect}, strconv.Itoa(reconnect)...))
+	}
+	return msgs
+}
+
+// LoadPreferences reads the terminal preferences sent to the clients, the
+// xterm.js options as json. There are none if file is empty
+func LoadPreferences(file string) ([]byte, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = json.Compact(&buf, data)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Compression is the permessage-deflate level of the websockets, terminal
+// output is mostly small chunks and latency matters more than the ratio
+const Compression = flate.BestSpeed
+
+// RawOutput decodes the base64 output of a webtty message, other messages
+// are returned as is
+func RawOutput(p []byte) ([]byte, error) {
+	if len(p) == 0 || p[0] != Output {
+		return p, nil
+	}
+	q := make([]byte, 1+base64.StdEncoding.DecodedLen(len(p)-1))
+	q[0] = Output
+	n, err := base64.StdEncoding.Decode(q[1:], p[1:])
+	if err != nil {
+		return nil, err
+	}
+	return q[:n+1], nil
+}
+
+// FromClient converts a message of a proto client to webtty, ok is false
+// if webtty has no equivalent, e.g. the flow control of ttyd
+func FromClient(proto string, p []byte) ([]byte, bool) {
+	if proto != TTYD || len(p) == 0 {
+		return p, true
+	}
+	switch p[0] {
+	case ttydInput:
+		// p is not shared, the type is replaced in place
+		p[0] = Input
+	case ttydResize:
+		p[0] = ResizeTerminal
+	case ttydPause, ttydResume:
+		// the output is not buffered here, there is nothing to hold
+		return nil, false
+	default:
+		return nil, false
+	}
+	return p, true
+}
+
+// ToClient converts a webtty message with raw output, the form the relay
+// reads from the backends, to the proto of the client with its websocket
+// message type. ok is false if the client has no equivalent
+func ToClient(proto string, p []byte) (mt int, q []byte, ok bool) {
+	if len(p) == 0 {
+		return websocket.TextMessage, p, true
+	}
+	switch proto {
+	case WebttyBinary:
+		return websocket.BinaryMessage, p, true
+	case TTYD:
+		return toTTYD(p)
+	}
+	if p[0] == Output {
+		mt, q = OutputMessage(proto, p[1:])
+		return mt, q, true
+	}
+	return websocket.TextMessage, p, true
+}
+
+func toTTYD(p []byte) (mt int, q []byte, ok bool) {
+	switch p[0] {
+	case Output:
+		return websocket.BinaryMessage, append([]byte{ttydOutput}, p[1:]...), true
+	case SetWindowTitle:
+		return websocket.BinaryMessage, append([]byte{ttydTitle}, p[1:]...), true
+	case SetPreferences:
+		return websocket.BinaryMessage, append([]byte{ttydPreferences}, p[1:]...), true
+	}
+	// ttyd has no pong and reconnects on its own
+	return 0, nil, false
+}
+
+// OutputMessage frames the terminal output b for a proto client, base64 is
+// left to the legacy webtty ones
+func OutputMessage(proto string, b []byte) (int, []byte) {
+	switch proto {
+	case WebttyBinary:
+		return websocket.BinaryMessage, append([]byte{Output}, b...)
+	case TTYD:
+		return websocket.BinaryMessage, append([]byte{ttydOutput}, b...)
+	}
+	safeMessage := base64.StdEncoding.EncodeToString(b)
+	return websocket.TextMessage, append([]byte{Output}, []byte(safeMessage)...)
+}
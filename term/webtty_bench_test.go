@@ -0,0 +1,103 @@
+package term
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// benchOutput is 4k of terminal output, the size docker reads at once
+var benchOutput = func() []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 4096; i++ {
+		fmt.Fprintf(&buf, "-rw-r--r--  1 root root %8d Jan  1 00:00 \x1b[01;32mfile-%04d.log\x1b[0m\r\n", i*1031, i)
+	}
+	return buf.Bytes()[:4096]
+}()
+
+var benchProtos = []string{Webtty, WebttyBinary, TTYD}
+
+func BenchmarkOutputMessage(b *testing.B) {
+	for _, proto := range benchProtos {
+		b.Run(proto, func(b *testing.B) {
+			b.SetBytes(int64(len(benchOutput)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				OutputMessage(proto, benchOutput)
+			}
+		})
+	}
+}
+
+// BenchmarkToClient is the relay side, the output it reads from a backend
+// in raw form converted for the client
+func BenchmarkToClient(b *testing.B) {
+	p := append([]byte{Output}, benchOutput...)
+	for _, proto := range benchProtos {
+		b.Run(proto, func(b *testing.B) {
+			b.SetBytes(int64(len(benchOutput)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ToClient(proto, p)
+			}
+		})
+	}
+}
+
+// BenchmarkWcWrite writes the output through a loopback websocket, the
+// peer reads and drops it
+func BenchmarkWcWrite(b *testing.B) {
+	for _, proto := range benchProtos {
+		for _, deflate := range []bool{false, true} {
+			name := proto
+			if deflate {
+				name += "+deflate"
+			}
+			b.Run(name, func(b *testing.B) {
+				benchWcWrite(b, proto, deflate)
+			})
+		}
+	}
+}
+
+func benchWcWrite(b *testing.B, proto string, deflate bool) {
+	upgrader := websocket.Upgrader{Subprotocols: Protocols, EnableCompression: deflate}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	dialer := websocket.Dialer{Subprotocols: []string{proto}, EnableCompression: deflate}
+	c, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	c.SetCompressionLevel(Compression)
+	wc := &Wc{Conn: c, Proto: c.Subprotocol()}
+	if wc.Proto != proto {
+		b.Fatalf("subprotocol %q, want %q", wc.Proto, proto)
+	}
+	b.SetBytes(int64(len(benchOutput)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mt, p := OutputMessage(wc.Proto, benchOutput)
+		if _, err := wc.write(mt, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}